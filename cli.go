@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"net"
 	"strings"
 	"strconv"
+	"time"
 
 	"github.com/shawwwn/gole/s5"
 )
@@ -30,8 +35,18 @@ type TCPConfig struct {
 	LAddr *net.TCPAddr
 	RAddr *net.TCPAddr
 	FwdAddr net.Addr
+	Fwds []fwdTarget // -fwd=ID:addr, FwdAddr is unused then
+	RFwds []fwdTarget // -rfwd, listen addresses on the server, targets on the client
 	Enc string
 	Key string
+	Identity ed25519.PrivateKey
+	AuthPeers []ed25519.PublicKey
+	Obfs *ObfsConfig
+	TLS *TLSConfig
+	TTL int
+	STUN []string
+	Rendezvous *RendezvousConfig
+	PortMap *PortMapConfig
 	S5Conf *S5Config
 }
 func (c TCPConfig) getMode() string {
@@ -52,12 +67,27 @@ type UDPConfig struct {
 	LAddr *net.UDPAddr
 	RAddr *net.UDPAddr
 	FwdAddr net.Addr
+	Fwds []fwdTarget // -fwd=ID:addr, FwdAddr is unused then
+	RFwds []fwdTarget // -rfwd, listen addresses on the server, targets on the client
 	Proto string
 	KConf string
+	KCP *KCPConfig
 	TTL int
 	Enc string
 	Key string
+	Identity ed25519.PrivateKey
+	AuthPeers []ed25519.PublicKey
+	Obfs *ObfsConfig
+	STUN []string
+	Rendezvous *RendezvousConfig
+	Predict *PredictConfig
+	Cands []candidate // remote candidates, from remote_addr or rendezvous
+	Relay *RelayConfig
+	PortMap *PortMapConfig
 	S5Conf *S5Config
+	sessKey []byte // negotiated by PunchUDP()
+	peer *net.UDPAddr // punched through to, LAddr/RAddr stay as given
+	punchTries int // HELO rounds before giving up, punchMaxTries if 0
 }
 func (c UDPConfig) getMode() string {
 	return "udp"
@@ -74,6 +104,9 @@ func (c UDPConfig) getOp() string {
 
 var g_timeout int
 var g_verbose bool
+var g_persist bool
+var g_rekey_bytes int64
+var g_rekey_time time.Duration
 func ParseConfig(args []string) Config {
 	g_cmd := flag.NewFlagSet("tcp", flag.ExitOnError)
 	g_cmd.BoolVar(&g_verbose, "verbose", false, "turn on debug output")
@@ -81,22 +114,45 @@ func ParseConfig(args []string) Config {
 	g_help := g_cmd.Bool("help", false, "usage information")
 	g_cmd.BoolVar(g_help, "h", false, "")
 	g_cmd.IntVar(&g_timeout, "timeout", 30, "how long in seconds an idle connection timeout and exit")
-	g_enc := g_cmd.String("enc", "xor", "encryption method")
+	g_cmd.BoolVar(&g_persist, "persist", false, "punch again when the tunnel collapses, keeping forward listeners open")
+	g_enc := g_cmd.String("enc", "xor", "encryption method (list to show all)")
 	g_key := g_cmd.String("key", "", "encryption key (leave empty to disable encryption)")
+	g_obfs := g_cmd.String("obfs", "none", "traffic obfuscation (none|pad[,maxpad=N,jitter=DURATION,merge=DURATION])")
+	g_rekey := g_cmd.String("rekey", "", "rotate traffic keys after bytes=N[K|M|G] and/or time=DURATION")
+	g_identity := g_cmd.String("identity", "", "private key file used to prove our identity to the peer")
+	g_auth_peers := g_cmd.String("authorized-peers", "", "file of public keys allowed to connect, one per line")
+	g_stun := g_cmd.String("stun", "", "STUN servers to discover our public address with, host:port[,host:port]")
+	g_rendezvous := g_cmd.String("rendezvous", "", "get remote address from a rendezvous server, host:port,room=NAME")
+	g_relay := g_cmd.String("relay", "", "splice udp traffic through a relay if punching fails, host:port[,room=NAME]")
+	g_portmap := g_cmd.String("portmap", "off", "ask the router to map local_addr first (auto|upnp|natpmp|pcp|off[,gateway=IP])")
 
 	tcp_cmd := flag.NewFlagSet("tcp", flag.ExitOnError)
 	tcp_op := tcp_cmd.String("op", "holepunch", "operation to perform")
-	tcp_fwd := tcp_cmd.String("fwd", "", "forward to/from address in server/client mode")
+	var tcp_fwds fwdFlag
+	tcp_cmd.Var(&tcp_fwds, "fwd", "forward to/from address in server/client mode, repeatable as ID:addr")
+	var tcp_rfwds fwdFlag
+	tcp_cmd.Var(&tcp_rfwds, "rfwd", "reverse forward listen_addr:target_addr, server listens and client dials (repeatable)")
+	tcp_ttl := tcp_cmd.String("ttl", "0", "ttl of the SYNs sent while holepunching (auto to discover it)")
+	tcp_tls := tcp_cmd.String("tls", "off", "run TLS 1.3 over the punched socket (off|on|self|cert=path,key=path|pin=sha256|ca=path,name=host)")
 
 	udp_cmd := flag.NewFlagSet("udp", flag.ExitOnError)
-	udp_ttl := udp_cmd.Int("ttl", 0, "ttl value used in holepunching")
+	udp_ttl := udp_cmd.String("ttl", "0", "ttl value used in holepunching (auto to discover it)")
+	udp_predict := udp_cmd.String("predict", "off", "spray predicted ports against symmetric NATs (off|on[,range=N,sockets=N,step=N])")
 	udp_op := udp_cmd.String("op", "holepunch", "operation to perform")
 	udp_proto := udp_cmd.String("proto", "udp", "tunnel's transport layer protocol")
-	udp_fwd := udp_cmd.String("fwd", "", "forward to/from address in server/client mode")
+	var udp_fwds fwdFlag
+	udp_cmd.Var(&udp_fwds, "fwd", "forward to/from address in server/client mode, repeatable as ID:addr")
+	var udp_rfwds fwdFlag
+	udp_cmd.Var(&udp_rfwds, "rfwd", "reverse forward listen_addr:target_addr, server listens and client dials (repeatable)")
 
 	print_usage := func() {
 		fmt.Println("usage:")
 		fmt.Println("gole [GLOBAL_OPTIONS] MODE local_addr remote_addr MODE_OPTIONS")
+		fmt.Println("gole keygen [path]")
+		fmt.Println("gole stun-server [listen_addr [alt_addr]]")
+		fmt.Println("gole rendezvous [listen_addr]")
+		fmt.Println("gole relay [listen_addr]")
+		fmt.Println("gole natcheck stun_server[,stun_server2] [lifetime_max_seconds]")
 		fmt.Println("\nGLOBAL OPTIONS:")
 		g_cmd.PrintDefaults()
 		fmt.Println("\nMODE 'tcp' OPTIONS:")
@@ -110,6 +166,16 @@ func ParseConfig(args []string) Config {
 		print_usage()
 		os.Exit(0)
 	}
+	if *g_enc == "list" {
+		for _, name := range cipherNames() {
+			fmt.Println(name)
+		}
+		os.Exit(0)
+	}
+	if getCipher(*g_enc) == nil {
+		perror("Unknown encryption method:", *g_enc, "(-enc=list to show all)")
+		os.Exit(1)
+	}
 	args = g_cmd.Args()
 
 	if len(args) <= 0 {
@@ -117,6 +183,114 @@ func ParseConfig(args []string) Config {
 		os.Exit(1)
 	}
 
+	// standalone commands
+	switch strings.ToLower(args[0]) {
+	case "keygen":
+		path := "gole_id"
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := KeyGen(path); err != nil {
+			perror("keygen failed.", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "stun-server":
+		addr, alt := fmt.Sprintf(":%d", stunDefaultPort), ""
+		if len(args) > 1 {
+			addr = args[1]
+		}
+		if len(args) > 2 {
+			alt = args[2]
+		}
+		if err := StunServer(addr, alt); err != nil {
+			perror("stun-server failed.", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "natcheck":
+		if len(args) < 2 {
+			perror("natcheck needs a STUN server, ideally 'gole stun-server' with an alternate address")
+			os.Exit(1)
+		}
+		lifetime := 60
+		if len(args) > 2 {
+			var err error
+			if lifetime, err = strconv.Atoi(args[2]); err != nil {
+				perror("Invalid lifetime:", args[2])
+				os.Exit(1)
+			}
+		}
+		report, err := NATCheck(strings.Split(args[1], ","), time.Duration(lifetime)*time.Second)
+		if err != nil {
+			perror("natcheck failed.", err)
+			os.Exit(1)
+		}
+		report.Print()
+		os.Exit(0)
+	case "rendezvous":
+		addr := fmt.Sprintf(":%d", rendezvousDefaultPort)
+		if len(args) > 1 {
+			addr = args[1]
+		}
+		if err := RendezvousServer(addr); err != nil {
+			perror("rendezvous failed.", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "relay":
+		addr := fmt.Sprintf(":%d", relayDefaultPort)
+		if len(args) > 1 {
+			addr = args[1]
+		}
+		if err := RelayServer(addr); err != nil {
+			perror("relay failed.", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	parseRekey(*g_rekey)
+	var stun []string
+	if *g_stun != "" {
+		stun = strings.Split(*g_stun, ",")
+	}
+	rendezvous := parseRendezvous(*g_rendezvous)
+	portmap := parsePortMap(*g_portmap)
+	relay := parseRelay(*g_relay, rendezvous)
+	obfs := parseObfs(*g_obfs)
+
+	var identity ed25519.PrivateKey
+	var auth_peers []ed25519.PublicKey
+	if *g_identity != "" {
+		var err error
+		identity, err = loadIdentity(*g_identity)
+		if err != nil {
+			perror("Failed to load identity.", err)
+			os.Exit(1)
+		}
+	}
+	if *g_auth_peers != "" {
+		var err error
+		auth_peers, err = loadAuthorizedPeers(*g_auth_peers)
+		if err != nil {
+			perror("Failed to load authorized peers.", err)
+			os.Exit(1)
+		}
+		if len(auth_peers) == 0 {
+			perror("No authorized peers in", *g_auth_peers)
+			os.Exit(1)
+		}
+	}
+	// without either the relay could answer the handshake in the peer's place
+	if relay != nil && *g_key == "" && (identity == nil || auth_peers == nil) {
+		perror("-relay needs -key, or -identity with -authorized-peers, so that the relay only ever sees ciphertext")
+		os.Exit(1)
+	}
+	if *g_key == "" && identity == nil {
+		fmt.Printf("WARNING: no -key or -identity, anyone can pass the handshake and the tunnel is not encrypted\n")
+	}
+
 	if len(args) < 1 {
 		fmt.Printf("must select a mode (tcp|udp)\n")
 		os.Exit(1)
@@ -127,64 +301,133 @@ func ParseConfig(args []string) Config {
 	}
 	l_endpt := args[1]
 	r_endpt := args[2]
+	if r_endpt == "-" && rendezvous == nil {
+		perror("remote_addr '-' needs -rendezvous to learn the remote address")
+		os.Exit(1)
+	}
 
 	mode := strings.ToLower(args[0]) 
 	switch mode {
 	case "tcp":
 		conf := new(TCPConfig)
-		conf.LAddr, _ = net.ResolveTCPAddr("tcp4", l_endpt)
-		conf.RAddr, _ = net.ResolveTCPAddr("tcp4", r_endpt)
+		if strings.Contains(r_endpt, ",") {
+			perror("Candidate lists in remote_addr only work in udp mode")
+			os.Exit(1)
+		}
+		conf.LAddr, _ = net.ResolveTCPAddr("tcp", l_endpt)
+		conf.RAddr, _ = net.ResolveTCPAddr("tcp", r_endpt)
+		if conf.LAddr != nil && conf.RAddr != nil {
+			checkFamily(conf.LAddr.IP, conf.RAddr.IP)
+		}
 		tcp_cmd.Parse(args[3:])
+		var tcp_fwd string
+		tcp_fwd, conf.Fwds = parseForwards(tcp_fwds)
 		conf.Op = *tcp_op
 		if ! contains(conf.Op, []string{"holepunch", "server", "client"}) {
 			perror("Unknown operation:", conf.Op)
 			os.Exit(1)
 		}
-		if strings.HasPrefix(*tcp_fwd, "socks5") {
+		conf.RFwds = parseReverseForwards(tcp_rfwds, conf.Op)
+		for _, f := range append(conf.Fwds, conf.RFwds...) {
+			if _, ok := f.addr.(*net.UDPAddr); ok {
+				perror("\"udp:\" forwards need 'udp' mode with -proto=kcp")
+				os.Exit(1)
+			}
+		}
+		if strings.HasPrefix(tcp_fwd, "socks5") {
 			if conf.Op != "server" {
 				perror("SOCKS5 proxy only works in server mode")
 				os.Exit(1)
 			}
 			conf.FwdAddr = nil
-			conf.S5Conf = parseSocks5(*tcp_fwd)
+			conf.S5Conf = parseSocks5(tcp_fwd)
 			s5.Dialer = conf.S5Conf.dialer
 			s5.Verbose = g_verbose
 		} else {
-			conf.FwdAddr, _ = net.ResolveTCPAddr("tcp4", *tcp_fwd)
+			conf.FwdAddr, _ = net.ResolveTCPAddr("tcp", tcp_fwd)
 		}
 		conf.Enc = *g_enc
 		conf.Key = *g_key
+		conf.Identity = identity
+		conf.AuthPeers = auth_peers
+		conf.Obfs = obfs
+		conf.TLS = parseTLS(*tcp_tls)
+		conf.TTL = parseTTL(*tcp_ttl)
+		conf.STUN = stun
+		conf.Rendezvous = rendezvous
+		conf.PortMap = portmap
+		if relay != nil {
+			perror("-relay only works in udp mode, a tcp tunnel can't move off the relay again")
+			os.Exit(1)
+		}
+		if conf.TLS != nil && conf.Op == "holepunch" {
+			perror("TLS only works in server or client mode")
+			os.Exit(1)
+		}
+		if conf.Enc == "xor" && conf.TLS == nil && g_rekey_time > 0 {
+			perror("-rekey=time needs an AEAD encryption method in tcp mode, xor streams can only rekey on bytes=")
+			os.Exit(1)
+		}
 		return conf
 
 	case "udp":
 		conf := new(UDPConfig)
-		conf.LAddr, _ = net.ResolveUDPAddr("udp4", l_endpt)
-		conf.RAddr, _ = net.ResolveUDPAddr("udp4", r_endpt)
+		conf.LAddr, _ = net.ResolveUDPAddr("udp", l_endpt)
+		if r_endpt != "-" && strings.ContainsAny(r_endpt, ",/") {
+			var err error
+			if conf.Cands, err = parseCandidates(r_endpt); err != nil {
+				perror("Invalid remote candidates.", err)
+				os.Exit(1)
+			}
+			conf.RAddr = conf.Cands[0].addr
+		} else {
+			conf.RAddr, _ = net.ResolveUDPAddr("udp", r_endpt)
+		}
+		if conf.LAddr != nil && conf.RAddr != nil {
+			checkFamily(conf.LAddr.IP, conf.RAddr.IP)
+		}
 		udp_cmd.Parse(args[3:])
-		conf.TTL = *udp_ttl
+		var udp_fwd string
+		udp_fwd, conf.Fwds = parseForwards(udp_fwds)
+		conf.TTL = parseTTL(*udp_ttl)
+		conf.Predict = parsePredict(*udp_predict)
 		conf.Op = *udp_op
 		if ! contains(conf.Op, []string{"holepunch", "server", "client"}) {
 			perror("Unknown operation:", conf.Op)
 			os.Exit(1)
 		}
+		conf.RFwds = parseReverseForwards(udp_rfwds, conf.Op)
 		conf.Enc = *g_enc
 		conf.Key = *g_key
+		conf.Identity = identity
+		conf.AuthPeers = auth_peers
+		conf.Obfs = obfs
+		conf.STUN = stun
+		conf.Rendezvous = rendezvous
+		conf.Relay = relay
+		conf.PortMap = portmap
 
 		parseProto(*udp_proto, conf)
+		if conf.Proto == "udp" && len(conf.Fwds) + len(conf.RFwds) > 0 {
+			perror("Forwards with ids and reverse forwards need -proto=kcp")
+			os.Exit(1)
+		}
 		if conf.Proto == "udp" {
-			conf.FwdAddr, _ = net.ResolveUDPAddr("udp4", *udp_fwd)
+			conf.FwdAddr, _ = net.ResolveUDPAddr("udp", strings.TrimPrefix(udp_fwd, "udp:"))
 		} else if conf.Proto == "kcp" {
-			if strings.HasPrefix(*udp_fwd, "socks5") {
+			if strings.HasPrefix(udp_fwd, "udp:") {
+				conf.FwdAddr, _ = net.ResolveUDPAddr("udp", strings.TrimPrefix(udp_fwd, "udp:"))
+			} else if strings.HasPrefix(udp_fwd, "socks5") {
 				if conf.Op != "server" {
 					perror("SOCKS5 proxy only works in server mode")
 					os.Exit(1)
 				}
 				conf.FwdAddr = nil
-				conf.S5Conf = parseSocks5(*udp_fwd)
+				conf.S5Conf = parseSocks5(udp_fwd)
 				s5.Dialer = conf.S5Conf.dialer
 				s5.Verbose = g_verbose
 			} else {
-				conf.FwdAddr, _ = net.ResolveTCPAddr("tcp4", *udp_fwd)
+				conf.FwdAddr, _ = net.ResolveTCPAddr("tcp", udp_fwd)
 			}
 		}
 
@@ -202,6 +445,18 @@ func ParseConfig(args []string) Config {
 	return nil
 }
 
+// A wildcard local address is dual-stack, a specific one must be of the
+// same family as the remote address.
+func checkFamily(l, r net.IP) {
+	if l == nil || l.IsUnspecified() || r == nil {
+		return
+	}
+	if (l.To4() == nil) != (r.To4() == nil) {
+		perror("local_addr and remote_addr must both be IPv4 or both be IPv6")
+		os.Exit(1)
+	}
+}
+
 // Params: -fwd="socks5"
 //         -fwd="socks5,bind=192.168.1.64,fwmark=10,dscp=46"
 func parseSocks5(ss string) *S5Config {
@@ -224,7 +479,7 @@ func parseSocks5(ss string) *S5Config {
 			case "dscp":
 				s5conf.dscp, _ = strconv.Atoi(val)
 			default:
-				perror("Unknown SOCKS5 parameters: %s", v)
+				perror("Unknown SOCKS5 parameters:", v)
 				os.Exit(1)
 			}
 		}
@@ -235,6 +490,151 @@ func parseSocks5(ss string) *S5Config {
 	return s5conf
 }
 
+// Params: -tls="off"
+//         -tls="self"
+//         -tls="cert=server.crt,key=server.key"
+//         -tls="pin=<sha256 of server certificate>"
+//         -tls="ca=ca.crt"
+func parseTLS(ss string) *TLSConfig {
+	if ss == "off" || ss == "" {
+		return nil
+	}
+	tc := &TLSConfig{}
+	for _, v := range strings.Split(ss, ",") {
+		ks := strings.SplitN(v, "=", 2)
+		key := ks[0]
+		val := ""
+		if len(ks)>1 {
+			val = ks[1]
+		}
+		var err error
+		switch key {
+		case "on":
+		case "self":
+			tc.Self = true
+		case "cert":
+			tc.Cert = val
+		case "key":
+			tc.Key = val
+		case "pin":
+			tc.Pin, err = hex.DecodeString(strings.TrimPrefix(strings.ReplaceAll(val, ":", ""), "sha256"))
+			if len(tc.Pin) != sha256.Size {
+				err = errors.New("bad fingerprint")
+			}
+		case "ca":
+			tc.CA = val
+		case "name":
+			tc.Name = val
+		default:
+			err = errors.New("unknown parameter")
+		}
+		if err != nil {
+			perror("Invalid tls parameter:", v)
+			os.Exit(1)
+		}
+	}
+	if (tc.Cert == "") != (tc.Key == "") {
+		perror("TLS needs both cert= and key=")
+		os.Exit(1)
+	}
+	if tc.CA != "" && tc.Name == "" && tc.Pin == nil {
+		perror("TLS ca= needs the server's name= or a pin=")
+		os.Exit(1)
+	}
+	return tc
+}
+
+// Params: -obfs="none"
+//         -obfs="pad,maxpad=256,jitter=10ms,merge=5ms"
+func parseObfs(ss string) *ObfsConfig {
+	ps := strings.Split(ss, ",")
+	if ps[0] == "none" {
+		return nil
+	} else if ps[0] != "pad" {
+		perror("Unknown obfuscation method:", ps[0])
+		os.Exit(1)
+	}
+
+	oc := &ObfsConfig{256, 0, 0}
+	for _, v := range ps[1:] {
+		ks := strings.SplitN(v, "=", 2)
+		key := ks[0]
+		val := ""
+		if len(ks)>1 {
+			val = ks[1]
+		}
+		var err error
+		switch key {
+		case "maxpad":
+			oc.MaxPad, err = strconv.Atoi(val)
+			if oc.MaxPad < 0 || oc.MaxPad > 65535 {
+				err = errors.New("out of range")
+			}
+		case "jitter":
+			oc.Jitter, err = time.ParseDuration(val)
+		case "merge":
+			oc.Merge, err = time.ParseDuration(val)
+		default:
+			err = errors.New("unknown parameter")
+		}
+		if err != nil {
+			perror("Invalid obfs parameter:", v)
+			os.Exit(1)
+		}
+	}
+	return oc
+}
+
+// Params: -rekey="bytes=1G"
+//         -rekey="bytes=512M,time=1h"
+func parseRekey(ss string) {
+	if ss == "" {
+		return
+	}
+	for _, v := range strings.Split(ss, ",") {
+		ks := strings.SplitN(v, "=", 2)
+		key := ks[0]
+		val := ""
+		if len(ks)>1 {
+			val = ks[1]
+		}
+		var err error
+		switch key {
+		case "bytes":
+			g_rekey_bytes, err = parseSize(val)
+		case "time":
+			g_rekey_time, err = time.ParseDuration(val)
+		default:
+			err = errors.New("unknown parameter")
+		}
+		if err != nil || g_rekey_bytes < 0 || g_rekey_time < 0 {
+			perror("Invalid rekey parameter:", v)
+			os.Exit(1)
+		}
+	}
+}
+
+// parse a byte count with an optional K|M|G suffix
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	mul := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mul = 1 << 10
+	case "M":
+		mul = 1 << 20
+	case "G":
+		mul = 1 << 30
+	}
+	if mul != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mul, err
+}
+
 // Params: -proto="kcp,conf=<path>"
 //         -proto="udp"
 func parseProto(ss string, conf *UDPConfig) {
@@ -258,6 +658,12 @@ func parseProto(ss string, conf *UDPConfig) {
 				}
 			}
 		}
+		conf.KCP = getKCPConfig(conf.KConf)
+		if conf.KCP.Key == kcpDefaultKey && conf.KCP.Crypt != "none" {
+			perror(fmt.Sprintf("Refuse to use the well-known KCP key \"%s\" from %s,", kcpDefaultKey, conf.KConf))
+			perror("remove \"key\" to derive it from the session key, or set \"crypt\": \"none\"")
+			os.Exit(1)
+		}
 	} else if conf.Proto == "udp" {
 		// ...
 	} else {
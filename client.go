@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"net"
+	"sync"
 	"time"
 
 	kcp "github.com/xtaci/kcp-go"
@@ -26,73 +26,15 @@ func StartClient(conn net.Conn, conf Config) {
 
 func StartClientTCP(conn net.Conn, conf *TCPConfig) {
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.TCPConn:
-			conn = NewEConn(conn, conf.Enc, conf.Key)
-		}
-	}
-
 	// Setup client side of smux
-	var interval int = g_timeout/3
-	interval = bound(interval, 1, 10)
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 1
-	smuxConfig.MaxReceiveBuffer = 4194304
-	smuxConfig.MaxStreamBuffer = 2097152
-	smuxConfig.KeepAliveInterval = time.Duration(interval) * time.Second
-	smuxConfig.KeepAliveTimeout = time.Duration(g_timeout) * time.Second
-	if err := smux.VerifyConfig(smuxConfig); err != nil {
-		perror("smux.VerifyConfig() failed.", err)
-		os.Exit(1)
-	}
-
-	sess, err := smux.Client(conn, smuxConfig)
+	sess, err := smux.Client(conn, newSmuxConfig())
 	if err != nil {
 		perror("smux.Client() failed.", err)
-		os.Exit(1)
+		exit(1)
 	}
 	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", sess.LocalAddr(), sess.RemoteAddr())
 
-	// listen for connections from forward address
-	lis, err := net.ListenTCP("tcp", conf.FwdAddr.(*net.TCPAddr))
-	if err != nil {
-		perror("net.Listen() failed.", err)
-		os.Exit(1)
-	}
-	defer lis.Close()
-	fmt.Printf("Waiting for new connections from %s ...\n", conf.FwdAddr.String())
-
-	// periodic check if smux session is still alive
-	go func() {
-		for {
-			time.Sleep(2*time.Second)
-			if sess.IsClosed() {
-				lis.Close()
-				fmt.Printf("tunnel is closed\n")
-				break
-			}
-		}
-	}()
-
-	for {
-		fwd_conn, err := lis.Accept()
-		if err != nil {
-			perror("lis.Accept() failed.", err)
-			break
-		}
-
-		stream, err := sess.OpenStream()
-		if err != nil {
-			perror("sess.OpenStream() failed.", err)
-			fwd_conn.Close()
-			break
-		}
-		PrintDbgf("stream open(%d): %v --> tunnel\n", stream.ID(), fwd_conn.RemoteAddr())
-
-		go conn2stream(fwd_conn, stream)
-	}
+	forwardClient(sess, conf.FwdAddr, conf.Fwds, conf.RFwds)
 
 	// clean up
 	fmt.Printf("...\n")
@@ -104,22 +46,14 @@ func StartClientTCP(conn net.Conn, conf *TCPConfig) {
 
 func StartClientKCP(conn net.PacketConn, conf *UDPConfig) {
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.UDPConn:
-			conn = NewEPacketConn(conn, conf.Enc, conf.Key)
-		}
-	}
-
 	// setup kcp
-	kconf := getKCPConfig(conf.KConf)
+	kconf := conf.KCP
 	PrintDbgf("%T: %v\n", kconf, kconf)
-	block := getKCPBlockCipher(kconf)
-	kconn, err := kcp.NewConn2(conf.RAddr, block, kconf.DataShard, kconf.ParityShard, conn)
+	block := getKCPBlockCipher(kconf, conf.sessKey)
+	kconn, err := kcp.NewConn2(conf.peer, block, kconf.DataShard, kconf.ParityShard, conn)
 	if err != nil {
 		perror("kcp.NewConn2() failed.", err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	kconn.SetStreamMode(true)
@@ -131,73 +65,25 @@ func StartClientKCP(conn net.PacketConn, conf *UDPConfig) {
 	if err := SetDSCP(conn.(net.Conn), kconf.DSCP); err != nil {
 		perror("SetDSCP() failed.", err)
 	}
-	if err := kconn.SetReadBuffer(kconf.SockBuf); err != nil {
-		perror("kconn.SetReadBuffer() failed.", err)
-	}
-	if err := kconn.SetWriteBuffer(kconf.SockBuf); err != nil {
-		perror("kconn.SetWriteBuffer() failed.", err)
+	if isUDPSocket(conn) {
+		if err := kconn.SetReadBuffer(kconf.SockBuf); err != nil {
+			perror("kconn.SetReadBuffer() failed.", err)
+		}
+		if err := kconn.SetWriteBuffer(kconf.SockBuf); err != nil {
+			perror("kconn.SetWriteBuffer() failed.", err)
+		}
 	}
 	kconn.Write([]byte{1,3,0,0,0,0,0,0}) // smux cmdNOP, let remote know we are connected
 
 	// Setup client side of smux
-	var interval int = g_timeout/3
-	interval = bound(interval, 1, 10)
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 1
-	smuxConfig.MaxReceiveBuffer = 4194304
-	smuxConfig.MaxStreamBuffer = 2097152
-	smuxConfig.KeepAliveInterval = time.Duration(interval) * time.Second
-	smuxConfig.KeepAliveTimeout = time.Duration(g_timeout) * time.Second
-	if err := smux.VerifyConfig(smuxConfig); err != nil {
-		perror("smux.VerifyConfig() failed.", err)
-		os.Exit(1)
-	}
-
-	sess, err := smux.Client(kconn, smuxConfig)
+	sess, err := smux.Client(kconn, newSmuxConfig())
 	if err != nil {
 		perror("smux.Client() failed.", err)
-		os.Exit(1)
+		exit(1)
 	}
 	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", sess.LocalAddr(), sess.RemoteAddr())
 
-	// listen from forward
-	lis, err := net.ListenTCP("tcp", conf.FwdAddr.(*net.TCPAddr))
-	if err != nil {
-		perror("net.Listen() failed.", err)
-		os.Exit(1)
-	}
-	defer lis.Close()
-	fmt.Printf("Waiting for new connections from %s ...\n", conf.FwdAddr.String())
-
-	// periodic check if smux session is still alive
-	go func() {
-		for {
-			time.Sleep(2*time.Second)
-			if sess.IsClosed() {
-				lis.Close()
-				fmt.Printf("tunnel is closed\n")
-				break
-			}
-		}
-	}()
-
-	for {
-		fwd_conn, err := lis.Accept()
-		if err != nil {
-			perror("lis.Accept() failed.", err)
-			break
-		}
-
-		stream, err := sess.OpenStream()
-		if err != nil {
-			perror("sess.OpenStream() failed.", err)
-			fwd_conn.Close()
-			break
-		}
-		PrintDbgf("stream open(%d): %v --> tunnel\n", stream.ID(), fwd_conn.RemoteAddr())
-
-		go conn2stream(fwd_conn, stream)
-	} // AcceptTCP()
+	forwardClient(sess, conf.FwdAddr, conf.Fwds, conf.RFwds)
 
 	// clean up
 	fmt.Printf("...\n")
@@ -208,46 +94,92 @@ func StartClientKCP(conn net.PacketConn, conf *UDPConfig) {
 	time.Sleep(time.Second)
 }
 
-func StartClientUDP(conn net.PacketConn, conf *UDPConfig) {
+// The forward socket of a 'udp' tunnel. With -persist the same socket
+// serves every re-punched tunnel, closing it only wakes up the reader.
+type udpForward struct {
+	mu sync.Mutex
+	conn *net.UDPConn
+	gen int // tunnel currently using conn
+}
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.UDPConn:
-			conn = NewEPacketConn(conn, conf.Enc, conf.Key)
-		}
+var g_fwdUDP *udpForward // -persist only
+
+// hand the socket to a new tunnel, returns its generation
+func (fwd *udpForward) take() int {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	fwd.gen++
+	fwd.conn.SetReadDeadline(time.Time{})
+	return fwd.gen
+}
+
+// close the socket for tunnel @gen, a collapsed tunnel closing late
+// leaves its successor alone
+func (fwd *udpForward) close(gen int) {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	if gen != fwd.gen {
+		return
+	}
+	if g_persist {
+		fwd.conn.SetReadDeadline(time.Now())
+	} else {
+		fwd.conn.Close()
 	}
+}
+
+func StartClientUDP(conn net.PacketConn, conf *UDPConfig) {
 
-	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", conf.LocalAddr(), conf.RemoteAddr())
+	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", conn.LocalAddr(), conf.peer)
 	fmt.Printf("Listen on forward address: %s\n", conf.FwdAddr)
 
-	fwd_conn, err := net.ListenUDP("udp", conf.FwdAddr.(*net.UDPAddr))
-	if err != nil {
-		perror("net.ListenUDP() failed.", err)
-		os.Exit(1)
+	fwd := g_fwdUDP
+	if fwd == nil {
+		c, err := net.ListenUDP("udp", conf.FwdAddr.(*net.UDPAddr))
+		if err != nil {
+			perror("net.ListenUDP() failed.", err)
+			exit(1)
+		}
+		fwd = &udpForward{conn: c}
+		if g_persist {
+			g_fwdUDP = fwd
+		}
+	}
+	gen := fwd.take()
+	fwd_conn := fwd.conn
+	closeFwd := func() {
+		fwd.close(gen)
 	}
 
-	var client_addr *net.UDPAddr // address originates from client app
-	var sent chan struct{} = make(chan struct{}, 1)
-
-	// TODO: Below code for udp forwarding is just a prototype and should never 
-	//       be used in a production system as it only allows one connection.
-	//       Needs udp muxing.
+	// one flow per source address, so several apps can share the tunnel
+	flows := newUDPFlows()
+	go flows.expire(time.Duration(g_timeout) * time.Second)
+	defer flows.close()
 
 	// conn --> fwd_conn
 	go func() {
 		defer conn.Close()
-		defer fwd_conn.Close()
-		buf := make([]byte, 4096)
+		defer closeFwd()
+		// only traffic from the peer keeps the tunnel alive
+		buf := make([]byte, udpFlowHeader+4096)
+		conn.SetReadDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
 		for {
-			conn.SetDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
 			n, _, err := conn.ReadFrom(buf)
 			if err != nil {
 				fmt.Println("conn.ReadFromUDP() failed.", err)
 				return
 			}
-			<-sent // wait until client first send something
-			_, err = fwd_conn.WriteToUDP(buf[:n], client_addr)
+			if n < udpFlowHeader {
+				continue
+			}
+			f := flows.get(getFlowID(buf))
+			if f == nil {
+				PrintDbgf("drop datagram for unknown flow(%d)\n", getFlowID(buf))
+				continue
+			}
+			f.touch()
+			conn.SetReadDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
+			_, err = fwd_conn.WriteToUDP(buf[udpFlowHeader:n], f.addr)
 			if err != nil {
 				fmt.Println("fwd_conn.WriteToUDP() failed.", err)
 				return
@@ -258,35 +190,31 @@ func StartClientUDP(conn net.PacketConn, conf *UDPConfig) {
 	// fwd_conn --> conn
 	func() {
 		defer conn.Close()
-		defer fwd_conn.Close()
-		buf := make([]byte, 4096)
+		defer closeFwd()
+		buf := make([]byte, udpFlowHeader+4096)
 		for {
-			n, c_addr, err := fwd_conn.ReadFromUDP(buf)
+			n, c_addr, err := fwd_conn.ReadFromUDP(buf[udpFlowHeader:])
 			if err != nil {
 				fmt.Println("fwd_conn.ReadFromUDP() failed.", err)
 				return
 			}
 
-			// use the most recent client address
-			if client_addr==nil  {
-				client_addr = c_addr
-				PrintDbgf("connection from: %s\n", client_addr)
-				close(sent)
-			} else if !UDPAddrEqual(c_addr, client_addr) {
-				client_addr = c_addr
-				PrintDbgf("new connection from: %s\n", client_addr)
+			f, isNew := flows.lookup(c_addr)
+			if isNew {
+				PrintDbgf("flow open(%d): %s --> tunnel\n", f.id, c_addr)
 			}
+			f.touch()
+			putFlowID(buf, f.id)
 
-			_, err = conn.WriteTo(buf[:n], conf.RAddr)
+			_, err = conn.WriteTo(buf[:udpFlowHeader+n], conf.peer)
 			if err != nil {
 				fmt.Println("conn.Write() failed.", err)
 				return
 			}
-			conn.SetDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
 		}
 	}()
 
 	fmt.Println("...")
-	fmt.Printf("tunnel collapsed: [local]%v <--> [remote]%v\n", conf.LocalAddr(), conf.RemoteAddr())
+	fmt.Printf("tunnel collapsed: [local]%v <--> [remote]%v\n", conn.LocalAddr(), conf.peer)
 	time.Sleep(time.Second)
 }
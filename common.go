@@ -6,8 +6,12 @@ import (
 	"io"
 	"net"
 	"bytes"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"github.com/xtaci/smux"
 )
 
@@ -15,6 +19,33 @@ func perror(a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
 }
 
+var exitHooks []func()
+var exitOnce sync.Once
+var exitMu sync.Mutex
+
+// run @f when the process exits through exit() or a signal
+func atExit(f func()) {
+	exitMu.Lock()
+	exitHooks = append(exitHooks, f)
+	exitMu.Unlock()
+}
+
+func runExitHooks() {
+	exitOnce.Do(func() {
+		exitMu.Lock()
+		defer exitMu.Unlock()
+		for i:=len(exitHooks)-1; i>=0; i-- {
+			exitHooks[i]()
+		}
+	})
+}
+
+// os.Exit() that cleans up after us first
+func exit(code int) {
+	runExitHooks()
+	os.Exit(code)
+}
+
 func contains(s string, ss []string) bool {
 	for _, v := range ss {
 		if v == s {
@@ -116,11 +147,121 @@ func UDPAddrEqual(a, b *net.UDPAddr) bool {
 func SetDSCP(conn net.Conn, dscp int) error {
 	switch nc := conn.(type) {
 	case *EConnXor:
-		return ipv4.NewConn(nc.Conn()).SetTOS(dscp << 2)
+		return setTOS(nc.Conn(), dscp << 2)
+	case *EConnAEAD:
+		return setTOS(nc.Conn(), dscp << 2)
 	case *EPacketConnXor:
-		return ipv4.NewConn(nc.Conn()).SetTOS(dscp << 2)
+		return setTOS(nc.Conn(), dscp << 2)
+	case *EPacketConnAEAD:
+		return setTOS(nc.Conn(), dscp << 2)
+	case *ObfsConn:
+		return SetDSCP(nc.Conn(), dscp)
+	case *ObfsPacketConn:
+		return SetDSCP(nc.Conn(), dscp)
+	case *pathConn:
+		conn, _ := nc.path()
+		return SetDSCP(conn.(net.Conn), dscp)
+	}
+	return setTOS(conn, dscp << 2)
+}
+
+// check if a plain UDP socket lies under @conn's encryption and obfuscation,
+// socket buffers can't be set through a relayed path
+func isUDPSocket(conn net.PacketConn) bool {
+	for {
+		switch nc := conn.(type) {
+		case *net.UDPConn:
+			return true
+		case interface{ Conn() net.Conn }:
+			pc, ok := nc.Conn().(net.PacketConn)
+			if !ok {
+				return false
+			}
+			conn = pc
+		default:
+			return false
+		}
+	}
+}
+
+// check if address is an IPv6 one, v4-mapped addresses are not
+func isIPv6(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP != nil && a.IP.To4() == nil
+	case *net.TCPAddr:
+		return a.IP != nil && a.IP.To4() == nil
+	}
+	return false
+}
+
+// set IPv4 TOS or IPv6 traffic class, a dual-stack socket gets both
+func setTOS(conn net.Conn, tos int) error {
+	if !isIPv6(conn.LocalAddr()) {
+		return ipv4.NewConn(conn).SetTOS(tos)
+	}
+	err := ipv6.NewConn(conn).SetTrafficClass(tos)
+	if isWildcard(conn.LocalAddr()) {
+		ipv4.NewConn(conn).SetTOS(tos) // v4-mapped peers
+	}
+	return err
+}
+
+func isWildcard(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP == nil || a.IP.IsUnspecified()
+	case *net.TCPAddr:
+		return a.IP == nil || a.IP.IsUnspecified()
+	}
+	return false
+}
+
+// TTL towards an IPv4 peer, hop limit towards an IPv6 one
+func getTTL(conn net.Conn, v6 bool) (int, error) {
+	if v6 {
+		return ipv6.NewConn(conn).HopLimit()
+	}
+	return ipv4.NewConn(conn).TTL()
+}
+func setTTL(conn net.Conn, v6 bool, ttl int) error {
+	if v6 {
+		return ipv6.NewConn(conn).SetHopLimit(ttl)
+	}
+	return ipv4.NewConn(conn).SetTTL(ttl)
+}
+
+// dialer control, reuseControl() plus @ttl set before the SYN goes out,
+// the socket's default ttl comes back @restore later so the rest of the
+// handshake (our SYN-ACK in a simultaneous open) reaches the peer
+func ttlControl(v6 bool, ttl int, restore time.Duration) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := reuseControl(network, address, c); err != nil {
+			return err
+		}
+		var ttl0 int
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if ttl0, err = getsockoptTTL(fd, v6); err == nil {
+				err = setsockoptTTL(fd, v6, ttl)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return err
+		}
+		time.AfterFunc(restore, func() {
+			// fails harmlessly if the dial gave up and closed the socket
+			c.Control(func(fd uintptr) {
+				if err := setsockoptTTL(fd, v6, ttl0); err != nil {
+					perror("Restore TTL failed.", err)
+				}
+			})
+		})
+		return nil
 	}
-	return ipv4.NewConn(conn).SetTOS(dscp << 2)
 }
 
 // convert an interface name/hostname/url/ip to an ip address
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTTLControlRestore(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	dialer := &net.Dialer{Control: ttlControl(false, 3, 200*time.Millisecond)}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if ttl, err := getTTL(conn, false); err != nil || ttl != 3 {
+		t.Fatalf("ttl right after the SYN = %d, %v, want 3", ttl, err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if ttl, err := getTTL(conn, false); err != nil || ttl == 3 {
+		t.Fatalf("ttl not restored, %d, %v", ttl, err)
+	}
+}
+
+func TestIsUDPSocket(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+
+	if !isUDPSocket(udp) {
+		t.Fatal("plain socket not recognized")
+	}
+	if !isUDPSocket(NewEPacketConn(udp, "aead", "k")) {
+		t.Fatal("encrypted socket not recognized")
+	}
+	pc := newPathConn(udp.LocalAddr().(*net.UDPAddr), udp, udp.LocalAddr())
+	if isUDPSocket(NewEPacketConn(pc, "aead", "k")) {
+		t.Fatal("relayed path taken for a socket")
+	}
+}
@@ -4,20 +4,39 @@ import (
 	"errors"
 	"time"
 	"net"
+	"io"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/hmac"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
 
 	xor "github.com/templexxx/xorsimd"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 
 
+// Without framing the XOR stream can't signal a key change, so both sides
+// rotate keys deterministically every -rekey=bytes in each direction.
 type EConnXor struct {
 	conn net.Conn
-	key []byte
+	rkey []byte
+	wkey []byte
 	key_ri int // key read index
 	key_wi int // key write index
+	rcount int64 // bytes read since last rekey
+	wcount int64 // bytes written since last rekey
+}
+func newEConnXor(conn net.Conn, key []byte) *EConnXor {
+	return &EConnXor{conn: conn, rkey: key, wkey: key}
 }
 func (econn *EConnXor) Conn() net.Conn {
 	return econn.conn
@@ -26,14 +45,19 @@ func (econn *EConnXor) Read(b []byte) (n int, err error) {
 	n, err = econn.conn.Read(b)
 
 	// stream decrypt
-	sz := n
-	for i:=0; i<sz; {
-		ct := xor.Bytes(b[i:n], b[i:n], econn.key[econn.key_ri:])
-		if ct == 0 {
-			break
+	for i:=0; i<n; {
+		end := n
+		if g_rekey_bytes > 0 && int64(end-i) > g_rekey_bytes-econn.rcount {
+			end = i + int(g_rekey_bytes-econn.rcount)
 		}
-		econn.key_ri = (econn.key_ri+ct) % len(econn.key)
-		i += ct
+		xorRing(b[i:end], econn.rkey, &econn.key_ri)
+		econn.rcount += int64(end-i)
+		if g_rekey_bytes > 0 && econn.rcount >= g_rekey_bytes {
+			econn.rkey = nextKey(econn.rkey)
+			econn.key_ri, econn.rcount = 0, 0
+			PrintDbgf("rekey: read key updated\n")
+		}
+		i = end
 	}
 
 	return n, err
@@ -43,12 +67,18 @@ func (econn *EConnXor) Write(b []byte) (n int, err error) {
 	// stream encrypt
 	sz := len(b)
 	for i:=0; i<sz; {
-		ct := xor.Bytes(b[i:], b[i:], econn.key[econn.key_wi:])
-		if ct == 0 {
-			break
+		end := sz
+		if g_rekey_bytes > 0 && int64(end-i) > g_rekey_bytes-econn.wcount {
+			end = i + int(g_rekey_bytes-econn.wcount)
 		}
-		econn.key_wi = (econn.key_wi+ct) % len(econn.key)
-		i += ct
+		xorRing(b[i:end], econn.wkey, &econn.key_wi)
+		econn.wcount += int64(end-i)
+		if g_rekey_bytes > 0 && econn.wcount >= g_rekey_bytes {
+			econn.wkey = nextKey(econn.wkey)
+			econn.key_wi, econn.wcount = 0, 0
+			PrintDbgf("rekey: write key updated\n")
+		}
+		i = end
 	}
 
 	return econn.conn.Write(b)
@@ -90,9 +120,181 @@ func (econn *EConnXor) SyscallConn() (syscall.RawConn, error) {
 	return nil, errors.New("not implemented")
 }
 
+const (
+	packetSeqSize = 8
+	packetTagSize = 8
+	packetOverhead = 1 + packetSeqSize + packetTagSize
+	replayWindowSize = 1024 // in packets, multiple of 64
+)
+
+// Sliding window over received sequence numbers, rejects duplicates and
+// packets older than the window.
+type replayWindow struct {
+	mu sync.Mutex
+	init bool
+	top uint64 // highest sequence number seen
+	bits [replayWindowSize/64]uint64
+}
+func (w *replayWindow) bit(seq uint64) (int, uint64) {
+	i := seq % replayWindowSize
+	return int(i/64), uint64(1) << (i%64)
+}
+// Check @seq against the window and mark it seen, returns false if it
+// should be dropped.
+func (w *replayWindow) check(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.init {
+		w.init = true
+		w.top = seq
+	} else if seq > w.top {
+		if seq-w.top >= replayWindowSize {
+			w.bits = [replayWindowSize/64]uint64{}
+		} else {
+			for s:=w.top+1; s<seq; s++ {
+				i, m := w.bit(s)
+				w.bits[i] &^= m
+			}
+		}
+		w.top = seq
+	} else {
+		if w.top-seq >= replayWindowSize {
+			return false
+		}
+		if i, m := w.bit(seq); w.bits[i]&m != 0 {
+			return false
+		}
+	}
+	i, m := w.bit(seq)
+	w.bits[i] |= m
+	return true
+}
+
+// packet ciphers that can verify a datagram read off the raw socket
+type packetOpener interface {
+	Open(b, p []byte) (int, error)
+}
+
+// Keys of one epoch in the rekey chain.
+type epochKey struct {
+	key []byte
+	mac []byte
+	aead cipher.AEAD // packet AEAD, nil for xor
+}
+
+// Chain of per-epoch keys shared by both directions of a packet conn.
+// The sender moves to the next epoch when -rekey is due, the receiver
+// follows whatever epoch the peer's datagrams are tagged with.
+type packetKeyring struct {
+	mu sync.Mutex
+	keys map[uint64]*epochKey
+	top uint64 // highest epoch derived
+	send uint64 // our epoch
+	recv uint64 // highest epoch seen from peer
+	count int64 // bytes sent in current epoch
+	since time.Time // when current epoch started
+	newAEAD func([]byte) (cipher.AEAD, error) // nil for xor
+}
+func newPacketKeyring(key []byte, newAEAD func([]byte) (cipher.AEAD, error)) *packetKeyring {
+	kr := &packetKeyring{keys: make(map[uint64]*epochKey), since: time.Now(), newAEAD: newAEAD}
+	kr.keys[0] = kr.newEpochKey(key)
+	return kr
+}
+func (kr *packetKeyring) newEpochKey(key []byte) *epochKey {
+	ek := &epochKey{key: key, mac: make([]byte, 32)}
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("gole-packet-mac")), ek.mac)
+	if kr.newAEAD != nil {
+		k := make([]byte, 32)
+		io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("gole-packet-aead")), k)
+		ek.aead, _ = kr.newAEAD(k)
+	}
+	return ek
+}
+// caller must hold kr.mu
+func (kr *packetKeyring) get(e uint64) *epochKey {
+	for kr.top < e {
+		kr.keys[kr.top+1] = kr.newEpochKey(nextKey(kr.keys[kr.top].key))
+		kr.top++
+	}
+	return kr.keys[e]
+}
+// Epoch and keys to seal an @n byte datagram with, rotates if due.
+func (kr *packetKeyring) sendKey(n int) (uint64, *epochKey) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if rekeyDue(kr.count, kr.since) {
+		kr.send++
+		kr.count, kr.since = 0, time.Now()
+		kr.prune()
+		PrintDbgf("rekey: packet epoch %d\n", kr.send)
+	}
+	kr.count += int64(n)
+	return kr.send, kr.get(kr.send)
+}
+// Epochs near the peer's current one whose low byte is @w.
+func (kr *packetKeyring) recvKeys(w byte) (es []uint64, eks []*epochKey) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	lo := kr.recv
+	if lo > 0 {
+		lo--
+	}
+	for e:=lo; e<=kr.recv+3; e++ {
+		if byte(e) != w {
+			continue
+		}
+		if ek := kr.get(e); ek != nil {
+			es, eks = append(es, e), append(eks, ek)
+		}
+	}
+	return es, eks
+}
+// Peer has moved to epoch @e.
+func (kr *packetKeyring) accept(e uint64) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if e > kr.recv {
+		kr.recv = e
+		kr.prune()
+	}
+}
+// forget keys no longer needed by either direction, caller must hold kr.mu
+func (kr *packetKeyring) prune() {
+	low := kr.send
+	if kr.recv < low {
+		low = kr.recv
+	}
+	for e := range kr.keys {
+		if e+1 < low {
+			delete(kr.keys, e)
+		}
+	}
+}
+
+// Every datagram carries its key epoch, a sequence number and a truncated HMAC:
+//
+//   [1-byte epoch] xor([8-byte seq][payload]) [8-byte tag]
+//
+// Forged, replayed or out-of-window datagrams are dropped and counted.
 type EPacketConnXor struct {
 	conn net.PacketConn
-	key []byte
+	keys *packetKeyring
+	seq uint64 // last sent sequence number
+	window replayWindow
+	dropped uint64 // number of datagrams dropped
+	rbuf []byte
+	rmu sync.Mutex
+}
+func newEPacketConnXor(conn net.PacketConn, key []byte) *EPacketConnXor {
+	var seq [8]byte
+	rand.Read(seq[:])
+	return &EPacketConnXor{
+		conn: conn,
+		keys: newPacketKeyring(key, nil),
+		seq: binary.BigEndian.Uint64(seq[:]) >> 1, // random start, far from wrapping
+		rbuf: make([]byte, 65536),
+	}
 }
 func (econn *EPacketConnXor) Conn() net.Conn {
 	if nc, ok := econn.conn.(net.Conn); ok {
@@ -100,16 +302,73 @@ func (econn *EPacketConnXor) Conn() net.Conn {
 	}
 	return nil
 }
+// Number of datagrams dropped as forged, replayed or out of window.
+func (econn *EPacketConnXor) Dropped() uint64 {
+	return atomic.LoadUint64(&econn.dropped)
+}
+func (econn *EPacketConnXor) tag(ek *epochKey, b []byte) []byte {
+	mac := hmac.New(sha256.New, ek.mac)
+	mac.Write(b)
+	return mac.Sum(nil)[:packetTagSize]
+}
+func (econn *EPacketConnXor) seal(b []byte) []byte {
+	e, ek := econn.keys.sendKey(len(b))
+	out := make([]byte, 1+packetSeqSize+len(b), packetOverhead+len(b))
+	out[0] = byte(e)
+	binary.BigEndian.PutUint64(out[1:], atomic.AddUint64(&econn.seq, 1))
+	copy(out[1+packetSeqSize:], b)
+	xorKeystream(out[1:], out[1:], ek.key)
+	return append(out, econn.tag(ek, out)...)
+}
+// Verify and decrypt datagram @p into @b.
+func (econn *EPacketConnXor) Open(b, p []byte) (int, error) {
+	if len(p) < packetOverhead {
+		return 0, errPacketAuth
+	}
+	body, tag := p[:len(p)-packetTagSize], p[len(p)-packetTagSize:]
+	es, eks := econn.keys.recvKeys(body[0])
+	for i, ek := range eks {
+		if !hmac.Equal(tag, econn.tag(ek, body)) {
+			continue
+		}
+		body = body[1:]
+		xorKeystream(body, body, ek.key)
+		if !econn.window.check(binary.BigEndian.Uint64(body)) {
+			return 0, errPacketReplay
+		}
+		econn.keys.accept(es[i])
+		return copy(b, body[packetSeqSize:]), nil
+	}
+	return 0, errPacketAuth
+}
+func (econn *EPacketConnXor) drop(err error, addr net.Addr) {
+	n := atomic.AddUint64(&econn.dropped, 1)
+	PrintDbgf("drop datagram from %v: %v (%d dropped)\n", addr, err, n)
+}
 func (econn *EPacketConnXor) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = econn.conn.ReadFrom(b)
-	xor.Bytes(b, b[:n], []byte(econn.key))
-	return n, addr, err
+	econn.rmu.Lock()
+	defer econn.rmu.Unlock()
+	for {
+		n, addr, err = econn.conn.ReadFrom(econn.rbuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n, err = econn.Open(b, econn.rbuf[:n]); err == nil {
+			return n, addr, nil
+		}
+		econn.drop(err, addr)
+	}
 }
 func (econn *EPacketConnXor) WriteTo(b []byte, addr net.Addr) (n int, err error) {
-	xor.Bytes(b, b, []byte(econn.key))
-	return econn.conn.WriteTo(b, addr)
+	if _, err = econn.conn.WriteTo(econn.seal(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 func (econn *EPacketConnXor) Close() error {
+	if n := econn.Dropped(); n > 0 {
+		PrintDbgf("%d datagrams dropped by replay protection\n", n)
+	}
 	return econn.conn.Close()
 }
 func (econn *EPacketConnXor) LocalAddr() net.Addr {
@@ -147,17 +406,28 @@ func (econn *EPacketConnXor) SyscallConn() (syscall.RawConn, error) {
 func (econn *EPacketConnXor) Read(b []byte) (n int, err error) {
 	conn, ok := interface{}(econn.conn).(net.Conn)
 	if ok {
-		n, err = conn.Read(b)
-		xor.Bytes(b, b[:n], []byte(econn.key))
-		return n, err
+		econn.rmu.Lock()
+		defer econn.rmu.Unlock()
+		for {
+			n, err = conn.Read(econn.rbuf)
+			if err != nil {
+				return 0, err
+			}
+			if n, err = econn.Open(b, econn.rbuf[:n]); err == nil {
+				return n, nil
+			}
+			econn.drop(err, conn.RemoteAddr())
+		}
 	}
 	return 0, errors.New("not implemented")
 }
 func (econn *EPacketConnXor) Write(b []byte) (n int, err error) {
 	conn, ok := interface{}(econn.conn).(net.Conn)
 	if ok {
-		xor.Bytes(b, b, []byte(econn.key))
-		return conn.Write(b)
+		if _, err = conn.Write(econn.seal(b)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
 	}
 	return 0, errors.New("not implemented")
 }
@@ -169,13 +439,504 @@ func (econn *EPacketConnXor) RemoteAddr() net.Addr {
 	return nil
 }
 
+const (
+	packetSaltSize = 4
+	packetAEADHeader = 1 + packetSaltSize + packetSeqSize
+)
+
+// Datagrams under an AEAD method are sealed one by one:
+//
+//   [1-byte epoch][4-byte salt][8-byte seq] sealed(payload)
+//
+// Salt and seq form the nonce, the salt is picked at random per conn so
+// both peers never seal under the same nonce. The header is authenticated
+// as additional data and seq is checked against the replay window.
+type EPacketConnAEAD struct {
+	conn net.PacketConn
+	keys *packetKeyring
+	salt []byte
+	seq uint64 // last sent sequence number
+	window replayWindow
+	dropped uint64 // number of datagrams dropped
+	rbuf []byte
+	rmu sync.Mutex
+}
+func newEPacketConnAEAD(conn net.PacketConn, key []byte, newAEAD func([]byte) (cipher.AEAD, error)) *EPacketConnAEAD {
+	var seq [8]byte
+	rand.Read(seq[:])
+	salt := make([]byte, packetSaltSize)
+	rand.Read(salt)
+	return &EPacketConnAEAD{
+		conn: conn,
+		keys: newPacketKeyring(key, newAEAD),
+		salt: salt,
+		seq: binary.BigEndian.Uint64(seq[:]) >> 1, // random start, far from wrapping
+		rbuf: make([]byte, 65536),
+	}
+}
+func (econn *EPacketConnAEAD) Conn() net.Conn {
+	if nc, ok := econn.conn.(net.Conn); ok {
+		return nc
+	}
+	return nil
+}
+// Number of datagrams dropped as forged, replayed or out of window.
+func (econn *EPacketConnAEAD) Dropped() uint64 {
+	return atomic.LoadUint64(&econn.dropped)
+}
+func (econn *EPacketConnAEAD) seal(b []byte) []byte {
+	e, ek := econn.keys.sendKey(len(b))
+	out := make([]byte, packetAEADHeader, packetAEADHeader+len(b)+ek.aead.Overhead())
+	out[0] = byte(e)
+	copy(out[1:], econn.salt)
+	binary.BigEndian.PutUint64(out[1+packetSaltSize:], atomic.AddUint64(&econn.seq, 1))
+	return ek.aead.Seal(out, out[1:packetAEADHeader], b, out)
+}
+// Verify and decrypt datagram @p into @b.
+func (econn *EPacketConnAEAD) Open(b, p []byte) (int, error) {
+	if len(p) < packetAEADHeader {
+		return 0, errPacketAuth
+	}
+	hdr, body := p[:packetAEADHeader], p[packetAEADHeader:]
+	es, eks := econn.keys.recvKeys(hdr[0])
+	for i, ek := range eks {
+		data, err := ek.aead.Open(nil, hdr[1:], body, hdr)
+		if err != nil {
+			continue
+		}
+		if !econn.window.check(binary.BigEndian.Uint64(hdr[1+packetSaltSize:])) {
+			return 0, errPacketReplay
+		}
+		econn.keys.accept(es[i])
+		return copy(b, data), nil
+	}
+	return 0, errPacketAuth
+}
+func (econn *EPacketConnAEAD) drop(err error, addr net.Addr) {
+	n := atomic.AddUint64(&econn.dropped, 1)
+	PrintDbgf("drop datagram from %v: %v (%d dropped)\n", addr, err, n)
+}
+func (econn *EPacketConnAEAD) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	econn.rmu.Lock()
+	defer econn.rmu.Unlock()
+	for {
+		n, addr, err = econn.conn.ReadFrom(econn.rbuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n, err = econn.Open(b, econn.rbuf[:n]); err == nil {
+			return n, addr, nil
+		}
+		econn.drop(err, addr)
+	}
+}
+func (econn *EPacketConnAEAD) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if _, err = econn.conn.WriteTo(econn.seal(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+func (econn *EPacketConnAEAD) Close() error {
+	if n := econn.Dropped(); n > 0 {
+		PrintDbgf("%d datagrams dropped by replay protection\n", n)
+	}
+	return econn.conn.Close()
+}
+func (econn *EPacketConnAEAD) LocalAddr() net.Addr {
+	return econn.conn.LocalAddr()
+}
+func (econn *EPacketConnAEAD) SetDeadline(t time.Time) error {
+	return econn.conn.SetDeadline(t)
+}
+func (econn *EPacketConnAEAD) SetReadDeadline(t time.Time) error {
+	return econn.conn.SetReadDeadline(t)
+}
+func (econn *EPacketConnAEAD) SetWriteDeadline(t time.Time) error {
+	return econn.conn.SetWriteDeadline(t)
+}
+func (econn *EPacketConnAEAD) SetReadBuffer(bytes int) error {
+	if nc, ok := econn.conn.(*net.UDPConn); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("not implemented")
+}
+func (econn *EPacketConnAEAD) SetWriteBuffer(bytes int) error {
+	if nc, ok := econn.conn.(*net.UDPConn); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("not implemented")
+}
+func (econn *EPacketConnAEAD) SyscallConn() (syscall.RawConn, error) {
+	if nc, ok := econn.conn.(*net.UDPConn); ok {
+		return nc.SyscallConn()
+	}
+	return nil, errors.New("not implemented")
+}
+
+// for compatibility with net.Conn
+func (econn *EPacketConnAEAD) Read(b []byte) (n int, err error) {
+	conn, ok := interface{}(econn.conn).(net.Conn)
+	if ok {
+		econn.rmu.Lock()
+		defer econn.rmu.Unlock()
+		for {
+			n, err = conn.Read(econn.rbuf)
+			if err != nil {
+				return 0, err
+			}
+			if n, err = econn.Open(b, econn.rbuf[:n]); err == nil {
+				return n, nil
+			}
+			econn.drop(err, conn.RemoteAddr())
+		}
+	}
+	return 0, errors.New("not implemented")
+}
+func (econn *EPacketConnAEAD) Write(b []byte) (n int, err error) {
+	conn, ok := interface{}(econn.conn).(net.Conn)
+	if ok {
+		if _, err = conn.Write(econn.seal(b)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return 0, errors.New("not implemented")
+}
+func (econn *EPacketConnAEAD) RemoteAddr() net.Addr {
+	conn, ok := interface{}(econn.conn).(net.Conn)
+	if ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+const (
+	aeadSaltSize = 16
+	aeadMaxRecord = 16384 // max plaintext bytes per record
+)
+
+var errRecordAuth = errors.New("econn: record authentication failed")
+var errRecordTruncated = errors.New("econn: truncated record")
+var errRecordSize = errors.New("econn: invalid record size")
+var errPacketAuth = errors.New("econn: datagram authentication failed")
+var errPacketReplay = errors.New("econn: replayed datagram")
+
+const (
+	recData = 0
+	recKeyUpdate = 1 // sender switches to the next key after this record
+)
+
+// EConnAEAD frames the stream into length-prefixed sealed records:
+//
+//   [2-byte ciphertext length][ciphertext + tag]
+//
+// Each direction begins with a random salt from which that direction's key
+// is derived, so the record counter used as nonce never repeats under a key.
+// The first plaintext byte of a record is its type, a key update record
+// rotates that direction's key under -rekey without a round trip.
+type EConnAEAD struct {
+	conn net.Conn
+	key []byte
+	newAEAD func([]byte) (cipher.AEAD, error)
+	rkey []byte
+	wkey []byte
+	rd cipher.AEAD // read cipher, set once peer's salt arrives
+	wr cipher.AEAD // write cipher, set on first write
+	rseq uint64 // read record counter
+	wseq uint64 // write record counter
+	wcount int64 // bytes written under current write key
+	wtime time.Time // when current write key was set
+	rbuf []byte // decrypted bytes not yet returned by Read()
+	wmu sync.Mutex
+}
+func newEConnAEAD(conn net.Conn, key []byte, newAEAD func([]byte) (cipher.AEAD, error)) *EConnAEAD {
+	return &EConnAEAD{conn: conn, key: key, newAEAD: newAEAD}
+}
+func (econn *EConnAEAD) Conn() net.Conn {
+	return econn.conn
+}
+func (econn *EConnAEAD) deriveKey(salt []byte) []byte {
+	k := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, econn.key, salt, []byte("gole-aead")), k)
+	return k
+}
+func (econn *EConnAEAD) nonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+func (econn *EConnAEAD) setReadKey(k []byte) (err error) {
+	econn.rkey, econn.rseq = k, 0
+	econn.rd, err = econn.newAEAD(k)
+	return err
+}
+func (econn *EConnAEAD) setWriteKey(k []byte) (err error) {
+	econn.wkey, econn.wseq, econn.wcount, econn.wtime = k, 0, 0, time.Now()
+	econn.wr, err = econn.newAEAD(k)
+	return err
+}
+func (econn *EConnAEAD) readRecord() error {
+	if econn.rd == nil {
+		salt := make([]byte, aeadSaltSize)
+		if _, err := io.ReadFull(econn.conn, salt); err != nil {
+			return err
+		}
+		if err := econn.setReadKey(econn.deriveKey(salt)); err != nil {
+			return err
+		}
+	}
+
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(econn.conn, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errRecordTruncated
+		}
+		return err
+	}
+	sz := int(binary.BigEndian.Uint16(hdr))
+	if sz <= econn.rd.Overhead() || sz > aeadMaxRecord+econn.rd.Overhead() {
+		return errRecordSize
+	}
+
+	rec := make([]byte, sz)
+	if _, err := io.ReadFull(econn.conn, rec); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errRecordTruncated
+		}
+		return err
+	}
+	pt, err := econn.rd.Open(rec[:0], econn.nonce(econn.rseq), rec, hdr)
+	if err != nil {
+		return errRecordAuth
+	}
+	econn.rseq++
+
+	switch pt[0] {
+	case recData:
+		econn.rbuf = pt[1:]
+	case recKeyUpdate:
+		PrintDbgf("rekey: read key updated\n")
+		return econn.setReadKey(nextKey(econn.rkey))
+	default:
+		return errRecordAuth
+	}
+	return nil
+}
+func (econn *EConnAEAD) sealRecord(out []byte, typ byte, b []byte) []byte {
+	pt := append([]byte{typ}, b...)
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(len(pt)+econn.wr.Overhead()))
+	out = append(out, hdr...)
+	out = econn.wr.Seal(out, econn.nonce(econn.wseq), pt, hdr)
+	econn.wseq++
+	return out
+}
+func (econn *EConnAEAD) Read(b []byte) (n int, err error) {
+	for len(econn.rbuf) == 0 {
+		if err = econn.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(b, econn.rbuf)
+	econn.rbuf = econn.rbuf[n:]
+	return n, nil
+}
+func (econn *EConnAEAD) Write(b []byte) (n int, err error) {
+	econn.wmu.Lock()
+	defer econn.wmu.Unlock()
+
+	var out []byte
+	if econn.wr == nil {
+		salt := make([]byte, aeadSaltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return 0, err
+		}
+		if err = econn.setWriteKey(econn.deriveKey(salt)); err != nil {
+			return 0, err
+		}
+		out = append(out, salt...)
+	}
+
+	for i:=0; i<len(b); {
+		if rekeyDue(econn.wcount, econn.wtime) {
+			out = econn.sealRecord(out, recKeyUpdate, nil)
+			if err = econn.setWriteKey(nextKey(econn.wkey)); err != nil {
+				return 0, err
+			}
+			PrintDbgf("rekey: write key updated\n")
+		}
+		chunk := b[i:]
+		if len(chunk) > aeadMaxRecord-1 {
+			chunk = chunk[:aeadMaxRecord-1]
+		}
+		out = econn.sealRecord(out, recData, chunk)
+		econn.wcount += int64(len(chunk))
+		i += len(chunk)
+	}
+
+	if _, err = econn.conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+func (econn *EConnAEAD) Close() error {
+	return econn.conn.Close()
+}
+func (econn *EConnAEAD) LocalAddr() net.Addr {
+	return econn.conn.LocalAddr()
+}
+func (econn *EConnAEAD) RemoteAddr() net.Addr {
+	return econn.conn.RemoteAddr()
+}
+func (econn *EConnAEAD) SetDeadline(t time.Time) error {
+	return econn.conn.SetDeadline(t)
+}
+func (econn *EConnAEAD) SetReadDeadline(t time.Time) error {
+	return econn.conn.SetReadDeadline(t)
+}
+func (econn *EConnAEAD) SetWriteDeadline(t time.Time) error {
+	return econn.conn.SetWriteDeadline(t)
+}
+func (econn *EConnAEAD) SetReadBuffer(bytes int) error {
+	if nc, ok := econn.conn.(*net.TCPConn); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("not implemented")
+}
+func (econn *EConnAEAD) SetWriteBuffer(bytes int) error {
+	if nc, ok := econn.conn.(*net.TCPConn); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("not implemented")
+}
+func (econn *EConnAEAD) SyscallConn() (syscall.RawConn, error) {
+	if nc, ok := econn.conn.(*net.TCPConn); ok {
+		return nc.SyscallConn()
+	}
+	return nil, errors.New("not implemented")
+}
+
+// xor @b in place with ring @key, starting at and advancing index @ki
+func xorRing(b []byte, key []byte, ki *int) {
+	for i:=0; i<len(b); {
+		ct := xor.Bytes(b[i:], b[i:], key[*ki:])
+		*ki = (*ki+ct) % len(key)
+		i += ct
+	}
+}
+
+// next key in the rekey chain
+func nextKey(k []byte) []byte {
+	nk := make([]byte, len(k))
+	io.ReadFull(hkdf.New(sha256.New, k, nil, []byte("gole-rekey")), nk)
+	return nk
+}
+
+// whether traffic keys are due for rotation under -rekey
+func rekeyDue(n int64, since time.Time) bool {
+	return (g_rekey_bytes > 0 && n >= g_rekey_bytes) ||
+		(g_rekey_time > 0 && time.Since(since) >= g_rekey_time)
+}
+
+// xor @src with @key repeated as keystream
+func xorKeystream(dst, src, key []byte) {
+	for i:=0; i<len(src); i+=len(key) {
+		xor.Bytes(dst[i:], src[i:], key)
+	}
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+
+// stretch a user supplied key into key material for the ciphers below
+func deriveKey(key string) []byte {
+	return pbkdf2.Key([]byte(key), []byte("saltybiscuit"), 64, 4096, sha1.New)
+}
+
+// An encryption method selectable with -enc, wraps both stream and
+// packet conns given the key material from deriveKey() or the handshake.
+type cipherMethod struct {
+	name string
+	stream func(conn net.Conn, k []byte) net.Conn
+	packet func(conn net.PacketConn, k []byte) net.PacketConn
+}
+
+var cipherMethods []*cipherMethod
+
+func registerCipher(m *cipherMethod) {
+	cipherMethods = append(cipherMethods, m)
+}
+
+func getCipher(name string) *cipherMethod {
+	for _, m := range cipherMethods {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func cipherNames() []string {
+	names := make([]string, len(cipherMethods))
+	for i, m := range cipherMethods {
+		names[i] = m.name
+	}
+	return names
+}
+
+// register an AEAD, records for streams and sealed datagrams for packets
+func registerAEAD(name string, newAEAD func([]byte) (cipher.AEAD, error)) {
+	registerCipher(&cipherMethod{
+		name: name,
+		stream: func(conn net.Conn, k []byte) net.Conn {
+			return newEConnAEAD(conn, k[:32], newAEAD)
+		},
+		packet: func(conn net.PacketConn, k []byte) net.PacketConn {
+			return newEPacketConnAEAD(conn, k, newAEAD)
+		},
+	})
+}
+
+func init() {
+	registerCipher(&cipherMethod{
+		name: "xor",
+		stream: func(conn net.Conn, k []byte) net.Conn {
+			return newEConnXor(conn, k)
+		},
+		packet: func(conn net.PacketConn, k []byte) net.PacketConn {
+			return newEPacketConnXor(conn, k)
+		},
+	})
+	registerAEAD("chacha20-poly1305", chacha20poly1305.New)
+	registerAEAD("aes-256-gcm", newAESGCM)
+}
 
 func NewEConn(conn net.Conn, enc, key string) net.Conn {
-	k := pbkdf2.Key([]byte(key), []byte("saltybiscuit"), 64, 4096, sha1.New)
-	return &EConnXor{conn, k, 0, 0}
+	return newEConnKey(conn, enc, deriveKey(key))
+}
+
+func newEConnKey(conn net.Conn, enc string, k []byte) net.Conn {
+	m := getCipher(enc)
+	if m == nil {
+		m = getCipher("xor")
+	}
+	return m.stream(conn, k)
 }
 
 func NewEPacketConn(conn net.PacketConn, enc, key string) net.PacketConn {
-	k := pbkdf2.Key([]byte(key), []byte("saltybiscuit"), 64, 4096, sha1.New)
-	return &EPacketConnXor{conn, k}
+	return newEPacketConnKey(conn, enc, deriveKey(key))
+}
+
+func newEPacketConnKey(conn net.PacketConn, enc string, k []byte) net.PacketConn {
+	m := getCipher(enc)
+	if m == nil {
+		m = getCipher("xor")
+	}
+	return m.packet(conn, k)
 }
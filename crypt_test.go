@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// one direction of a stream, writes are kept for the test to rearrange
+type bufConn struct {
+	net.Conn
+	r *bytes.Reader
+	w bytes.Buffer
+}
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+func (c *bufConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func testAEADKey() []byte {
+	return bytes.Repeat([]byte{7}, 32)
+}
+
+// salt and records an EConnAEAD sends for each of @writes
+func sealRecords(t *testing.T, writes ...string) (salt []byte, recs [][]byte) {
+	t.Helper()
+	c := &bufConn{}
+	econn := newEConnAEAD(c, testAEADKey(), chacha20poly1305.New)
+	for _, s := range writes {
+		if _, err := econn.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := c.w.Bytes()
+	salt, b = b[:aeadSaltSize], b[aeadSaltSize:]
+	for len(b) > 0 {
+		n := 2 + int(binary.BigEndian.Uint16(b))
+		recs, b = append(recs, b[:n]), b[n:]
+	}
+	return salt, recs
+}
+
+// read everything in @stream back, returns the plaintext and the error
+// that stopped it
+func openRecords(stream []byte) (string, error) {
+	econn := newEConnAEAD(&bufConn{r: bytes.NewReader(stream)}, testAEADKey(), chacha20poly1305.New)
+	var out []byte
+	b := make([]byte, 64)
+	for {
+		n, err := econn.Read(b)
+		out = append(out, b[:n]...)
+		if err != nil {
+			return string(out), err
+		}
+	}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestEConnAEADRecords(t *testing.T) {
+	salt, recs := sealRecords(t, "one", "two")
+	if len(recs) != 2 {
+		t.Fatalf("%d records, want 2", len(recs))
+	}
+	tampered := append([]byte(nil), recs[1]...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name string
+		stream []byte
+		out string
+		err error
+	}{
+		{"tampered", join(salt, recs[0], tampered), "one", errRecordAuth},
+		{"truncated", join(salt, recs[0], recs[1][:len(recs[1])-3]), "one", errRecordTruncated},
+		{"out of order", join(salt, recs[1], recs[0]), "", errRecordAuth},
+		{"replayed", join(salt, recs[0], recs[0]), "one", errRecordAuth},
+	}
+	for _, tt := range tests {
+		out, err := openRecords(tt.stream)
+		if out != tt.out || err != tt.err {
+			t.Errorf("%s: read %q, %v, want %q, %v", tt.name, out, err, tt.out, tt.err)
+		}
+	}
+}
+
+func TestEConnAEADKeyUpdate(t *testing.T) {
+	g_rekey_bytes = 3
+	t.Cleanup(func() { g_rekey_bytes = 0 })
+
+	// [one][key update][two], records under the old key are refused after it
+	salt, recs := sealRecords(t, "one", "two")
+	if len(recs) != 3 {
+		t.Fatalf("%d records, want 3", len(recs))
+	}
+	if out, err := openRecords(join(salt, recs[0], recs[1], recs[2])); out != "onetwo" {
+		t.Fatalf("read %q, %v", out, err)
+	}
+	if out, err := openRecords(join(salt, recs[0], recs[1], recs[0])); out != "one" || err != errRecordAuth {
+		t.Fatalf("old key after update: read %q, %v, want %q, %v", out, err, "one", errRecordAuth)
+	}
+}
+
+func newTestPacketAEAD() *EPacketConnAEAD {
+	return newEPacketConnAEAD(nil, testAEADKey(), chacha20poly1305.New)
+}
+
+func TestEPacketConnAEADOpen(t *testing.T) {
+	tx, rx := newTestPacketAEAD(), newTestPacketAEAD()
+	p1, p2 := tx.seal([]byte("one")), tx.seal([]byte("two"))
+	b := make([]byte, 64)
+
+	tampered := append([]byte(nil), p1...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := rx.Open(b, tampered); err != errPacketAuth {
+		t.Fatalf("tampered: %v, want %v", err, errPacketAuth)
+	}
+	if _, err := rx.Open(b, p1[:len(p1)-1]); err != errPacketAuth {
+		t.Fatalf("truncated tag: %v, want %v", err, errPacketAuth)
+	}
+	if _, err := rx.Open(b, p1[:packetAEADHeader-1]); err != errPacketAuth {
+		t.Fatalf("truncated header: %v, want %v", err, errPacketAuth)
+	}
+
+	// reordering is fine for datagrams, replays are not
+	if n, err := rx.Open(b, p2); err != nil || string(b[:n]) != "two" {
+		t.Fatalf("p2: %q, %v", b[:n], err)
+	}
+	if n, err := rx.Open(b, p1); err != nil || string(b[:n]) != "one" {
+		t.Fatalf("p1 after p2: %q, %v", b[:n], err)
+	}
+	if _, err := rx.Open(b, p1); err != errPacketReplay {
+		t.Fatalf("replayed: %v, want %v", err, errPacketReplay)
+	}
+}
+
+func TestEPacketConnAEADKeyChange(t *testing.T) {
+	g_rekey_bytes = 6
+	t.Cleanup(func() { g_rekey_bytes = 0 })
+
+	// two datagrams per epoch
+	tx, rx := newTestPacketAEAD(), newTestPacketAEAD()
+	var ps [][]byte
+	for i := 0; i < 7; i++ {
+		ps = append(ps, tx.seal([]byte("abc")))
+	}
+	b := make([]byte, 64)
+
+	open := func(i int) error {
+		_, err := rx.Open(b, ps[i])
+		return err
+	}
+	if err := open(0); err != nil {
+		t.Fatal("epoch 0:", err)
+	}
+	if err := open(6); err != nil {
+		t.Fatal("epoch 3:", err)
+	}
+	if err := open(4); err != nil {
+		t.Fatal("epoch 2 after 3:", err)
+	}
+	if err := open(1); err != errPacketAuth {
+		t.Fatalf("epoch 0 after 3: %v, want %v", err, errPacketAuth)
+	}
+}
+
+// a key from another run never opens
+func TestEPacketConnAEADWrongKey(t *testing.T) {
+	tx := newTestPacketAEAD()
+	rx := newEPacketConnAEAD(nil, bytes.Repeat([]byte{8}, 32), chacha20poly1305.New)
+	if _, err := rx.Open(make([]byte, 64), tx.seal([]byte("one"))); err != errPacketAuth {
+		t.Fatalf("%v, want %v", err, errPacketAuth)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	const base = 1 << 40
+	tests := []struct {
+		name string
+		seqs []uint64
+		want []bool
+	}{
+		{"duplicate", []uint64{base, base}, []bool{true, false}},
+		{"reordered", []uint64{base, base + 2, base + 1, base + 1}, []bool{true, true, true, false}},
+		{"oldest in window", []uint64{base + replayWindowSize - 1, base}, []bool{true, true}},
+		{"too old", []uint64{base + replayWindowSize, base}, []bool{true, false}},
+		{"far ahead", []uint64{base, base + 5000, base + 4999, base}, []bool{true, true, true, false}},
+		{"jump clears the window", []uint64{base + 1, base + 1 + replayWindowSize, base + 2}, []bool{true, true, true}},
+		{"skipped bits cleared", []uint64{base + 5, base + 10, base + 6 + replayWindowSize, base + 5 + replayWindowSize}, []bool{true, true, true, true}},
+		{"below the first", []uint64{base, base - 1, base - replayWindowSize}, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		var w replayWindow
+		for i, seq := range tt.seqs {
+			if got := w.check(seq); got != tt.want[i] {
+				t.Errorf("%s: check #%d (%d) = %v, want %v", tt.name, i, seq, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPacketKeyringRecvKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		recv uint64 // peer's epoch so far
+		wire byte
+		want []uint64
+	}{
+		{"current", 5, 5, []uint64{5}},
+		{"previous", 5, 4, []uint64{4}},
+		{"ahead", 5, 8, []uint64{8}},
+		{"too far ahead", 5, 9, nil},
+		{"too old", 5, 3, nil},
+		{"first epoch", 0, 0, []uint64{0}},
+		{"rollover", 255, 0, []uint64{256}},
+		{"rollover ahead", 254, 1, []uint64{257}},
+		{"before rollover", 256, 255, []uint64{255}},
+	}
+	for _, tt := range tests {
+		kr := newPacketKeyring(testAEADKey(), nil)
+		kr.recv = tt.recv
+		es, _ := kr.recvKeys(tt.wire)
+		if len(es) != len(tt.want) || (len(es) > 0 && es[0] != tt.want[0]) {
+			t.Errorf("%s: recvKeys(%d) at epoch %d = %v, want %v", tt.name, tt.wire, tt.recv, es, tt.want)
+		}
+	}
+}
+
+// the packet side of both ciphers
+type packetSealer interface {
+	seal([]byte) []byte
+	Open([]byte, []byte) (int, error)
+}
+
+func TestRekeyRoundtrip(t *testing.T) {
+	t.Cleanup(func() { g_rekey_bytes, g_rekey_time = 0, 0 })
+	key := bytes.Repeat([]byte{7}, 64)
+
+	xorStream := func(c net.Conn) net.Conn { return newEConnXor(c, key[:32]) }
+	xorRekeyed := func(c net.Conn) bool { return !bytes.Equal(c.(*EConnXor).wkey, key[:32]) }
+	xorPacket := func() (packetSealer, packetSealer, *packetKeyring) {
+		tx := newEPacketConnXor(nil, key)
+		return tx, newEPacketConnXor(nil, key), tx.keys
+	}
+	aeadStream := func(c net.Conn) net.Conn { return newEConnAEAD(c, key[:32], chacha20poly1305.New) }
+	// 20 writes under one key would leave the record counter at 20 or more
+	aeadRekeyed := func(c net.Conn) bool { return c.(*EConnAEAD).wseq < 20 }
+	aeadPacket := func() (packetSealer, packetSealer, *packetKeyring) {
+		tx := newEPacketConnAEAD(nil, key, chacha20poly1305.New)
+		return tx, newEPacketConnAEAD(nil, key, chacha20poly1305.New), tx.keys
+	}
+
+	tests := []struct {
+		name string
+		bytes int64
+		every time.Duration
+		stream func(net.Conn) net.Conn // nil if the cipher can't rekey streams this way
+		rekeyed func(net.Conn) bool // whether the stream's write key moved on
+		packet func() (tx, rx packetSealer, keys *packetKeyring)
+	}{
+		{"xor", 250, 0, xorStream, xorRekeyed, xorPacket},
+		{"xor", 0, time.Nanosecond, nil, nil, xorPacket}, // no key update signal in xor streams
+		{"aead", 250, 0, aeadStream, aeadRekeyed, aeadPacket},
+		{"aead", 0, time.Nanosecond, aeadStream, aeadRekeyed, aeadPacket},
+	}
+
+	for _, tt := range tests {
+		g_rekey_bytes, g_rekey_time = tt.bytes, tt.every
+		name := fmt.Sprintf("%s bytes=%d time=%v", tt.name, tt.bytes, tt.every)
+
+		if tt.stream != nil {
+			c := &bufConn{}
+			tx := tt.stream(c)
+			var want []byte
+			for i := 0; i < 20; i++ {
+				b := bytes.Repeat([]byte{byte(i)}, 100+i)
+				want = append(want, b...)
+				if _, err := tx.Write(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rx := tt.stream(&bufConn{r: bytes.NewReader(c.w.Bytes())})
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(rx, got); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s: stream roundtrip failed, %v", name, err)
+			}
+			if !tt.rekeyed(tx) {
+				t.Errorf("%s: stream kept its key", name)
+			}
+		}
+
+		tx, rx, keys := tt.packet()
+		b := make([]byte, 256)
+		for i := 0; i < 20; i++ {
+			msg := bytes.Repeat([]byte{byte(i)}, 100)
+			n, err := rx.Open(b, tx.seal(msg))
+			if err != nil || !bytes.Equal(b[:n], msg) {
+				t.Errorf("%s: datagram %d failed, %v", name, i, err)
+				break
+			}
+		}
+		if keys.send == 0 {
+			t.Errorf("%s: datagrams kept their key", name)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+//
+// HELO/OKAY handshake messages and session key derivation
+//
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	protoVersion = 3
+	helloNonceSize = 16
+	helloMACSize = 32
+	helloMaxSize = 1024
+	sessionKeySize = 4096
+)
+
+var errAuthKey = errors.New("auth failed: wrong key")
+var errAuthVersion = errors.New("auth failed: protocol version mismatch")
+var errAuthPeer = errors.New("auth failed: unexpected peer")
+var errAuthIdentity = errors.New("auth failed: peer identity not verified")
+
+// A handshake message:
+//   [4-byte magic "HELO"|"OKAY"|"PICK"][1-byte version][4-byte pid]
+//   [32-byte X25519 pubkey][16-byte nonce]
+//   [1-byte len][Ed25519 identity pubkey, optional]
+// OKAY additionally answers the peer's challenge:
+//   [16-byte echoed nonce][32-byte HMAC over both HELOs]
+//   [1-byte len][Ed25519 signature over both HELOs, optional]
+// PICK is an OKAY that also nominates the path it arrives on, it is sent
+// by the side with the lower nonce when several paths are punched at once.
+// The answers bind both nonces, X25519 keys, PIDs and identities. Addresses
+// are left out since NATs rewrite them and neither side could verify the
+// other's view, where a message comes from is checked by the punchers.
+type hello struct {
+	magic string
+	ver byte
+	pid uint32
+	pub []byte
+	nonce []byte
+	id []byte // sender's identity
+	echo []byte
+	mac []byte
+	sig []byte
+}
+func (h *hello) String() string {
+	return fmt.Sprintf("%s-%d", h.magic, h.pid)
+}
+// fields covered by the OKAY mac
+func (h *hello) body() []byte {
+	b := []byte{h.ver, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], h.pid)
+	b = append(b, h.pub...)
+	b = append(b, h.nonce...)
+	b = append(b, byte(len(h.id)))
+	b = append(b, h.id...)
+	return b
+}
+func (h *hello) marshal() []byte {
+	b := append([]byte(h.magic), h.body()...)
+	if h.magic != "HELO" {
+		b = append(b, h.echo...)
+		b = append(b, h.mac...)
+		b = append(b, byte(len(h.sig)))
+		b = append(b, h.sig...)
+	}
+	return b
+}
+
+func parseHello(b []byte) (*hello, error) {
+	// a wrong key garbles everything, including the magic
+	if len(b) < 5 || !contains(string(b[:4]), []string{"HELO", "OKAY", "PICK"}) {
+		return nil, errAuthKey
+	}
+	h := &hello{magic: string(b[:4]), ver: b[4]}
+	if h.ver != protoVersion {
+		return nil, fmt.Errorf("%w (local v%d, remote v%d)", errAuthVersion, protoVersion, h.ver)
+	}
+
+	r := bytes.NewReader(b[5:])
+	short := false
+	readN := func(n int) []byte {
+		p := make([]byte, n)
+		if _, err := io.ReadFull(r, p); err != nil {
+			short = true
+		}
+		return p
+	}
+	readVar := func() []byte {
+		n, err := r.ReadByte()
+		if err != nil {
+			short = true
+		}
+		return readN(int(n))
+	}
+
+	pid := readN(4)
+	h.pub = readN(32)
+	h.nonce = readN(helloNonceSize)
+	h.id = readVar()
+	if h.magic != "HELO" {
+		h.echo = readN(helloNonceSize)
+		h.mac = readN(helloMACSize)
+		h.sig = readVar()
+	}
+	if short {
+		return nil, errAuthKey
+	}
+	h.pid = binary.BigEndian.Uint32(pid)
+	return h, nil
+}
+
+// Per-run handshake state, holds our ephemeral X25519 keypair.
+type handshake struct {
+	keyed bool // -key given
+	psk []byte // pre-shared key derived from -key
+	authkey []byte // HMAC key for the challenge-response
+	priv []byte
+	pub []byte
+	nonce []byte // our challenge
+	identity ed25519.PrivateKey // optional, sign our answers with it
+	authorized []ed25519.PublicKey // if set, only accept these peers
+}
+
+func newHandshake(key string) (*handshake, error) {
+	hs := &handshake{
+		keyed: key != "",
+		psk: deriveKey(key),
+		authkey: make([]byte, 32),
+		priv: make([]byte, curve25519.ScalarSize),
+		nonce: make([]byte, helloNonceSize),
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, hs.psk, nil, []byte("gole-auth")), hs.authkey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(hs.priv); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(hs.nonce); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(hs.priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	hs.pub = pub
+	return hs, nil
+}
+
+func (hs *handshake) hello() *hello {
+	h := &hello{
+		magic: "HELO",
+		ver: protoVersion,
+		pid: uint32(os.Getpid()),
+		pub: hs.pub,
+		nonce: hs.nonce,
+	}
+	if hs.identity != nil {
+		h.id = hs.identity.Public().(ed25519.PublicKey)
+	}
+	return h
+}
+
+// transcript binding the OKAY/PICK sender's HELO to the receiver's HELO
+func transcript(from, to *hello) []byte {
+	t := []byte("gole-" + strings.ToLower(from.magic))
+	t = append(t, from.body()...)
+	return append(t, to.body()...)
+}
+
+func (hs *handshake) mac(from, to *hello) []byte {
+	mac := hmac.New(sha256.New, hs.authkey)
+	mac.Write(transcript(from, to))
+	return mac.Sum(nil)
+}
+
+// Answer @peer's challenge.
+func (hs *handshake) okay(peer *hello) *hello {
+	return hs.answer("OKAY", peer)
+}
+
+// Answer @peer's challenge and nominate the path it is sent on.
+func (hs *handshake) pick(peer *hello) *hello {
+	return hs.answer("PICK", peer)
+}
+
+// whether we nominate the path when several are punched
+func (hs *handshake) controlling(peer *hello) bool {
+	return bytes.Compare(hs.nonce, peer.nonce) < 0
+}
+
+func (hs *handshake) answer(magic string, peer *hello) *hello {
+	h := hs.hello()
+	h.magic = magic
+	h.echo = peer.nonce
+	h.mac = hs.mac(h, peer)
+	if hs.identity != nil {
+		h.sig = ed25519.Sign(hs.identity, transcript(h, peer))
+	}
+	return h
+}
+
+// Sanity check a HELO or OKAY from the peer.
+func (hs *handshake) checkHello(peer *hello) error {
+	if bytes.Equal(peer.nonce, hs.nonce) || bytes.Equal(peer.pub, hs.pub) {
+		return fmt.Errorf("%w (received our own %s)", errAuthPeer, peer.magic)
+	}
+	return nil
+}
+
+// Verify the peer's answer to our challenge.
+func (hs *handshake) checkOkay(peer *hello) error {
+	if err := hs.checkHello(peer); err != nil {
+		return err
+	}
+	if !bytes.Equal(peer.echo, hs.nonce) {
+		return fmt.Errorf("%w (%s answers another challenge)", errAuthPeer, peer)
+	}
+	if !hmac.Equal(peer.mac, hs.mac(peer, hs.hello())) {
+		return errAuthKey
+	}
+	return hs.checkIdentity(peer)
+}
+
+// Verify the peer proves possession of an authorized identity.
+func (hs *handshake) checkIdentity(peer *hello) error {
+	if len(peer.id) == 0 {
+		if len(hs.authorized) > 0 {
+			perror("reject peer without identity")
+			return fmt.Errorf("%w (no identity presented)", errAuthIdentity)
+		}
+		return nil
+	}
+
+	id := ed25519.PublicKey(peer.id)
+	if len(id) != ed25519.PublicKeySize || !ed25519.Verify(id, transcript(peer, hs.hello()), peer.sig) {
+		return fmt.Errorf("%w (bad signature)", errAuthIdentity)
+	}
+	if len(hs.authorized) > 0 {
+		known := false
+		for _, k := range hs.authorized {
+			if k.Equal(id) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			perror("reject unknown peer", fingerprint(id))
+			return fmt.Errorf("%w (unknown identity %s)", errAuthPeer, fingerprint(id))
+		}
+	}
+	fmt.Printf("peer identity: %s\n", fingerprint(id))
+	return nil
+}
+
+// Whether the tunnel gets encrypted with the session key, identities on
+// either side replace the shared key so the tunnel is never left in plaintext.
+func (hs *handshake) encrypts(peer *hello) bool {
+	return hs.keyed || hs.identity != nil || len(peer.id) > 0
+}
+
+// Derive the tunnel key from the DH result and the pre-shared key.
+// Both nonces are mixed in so no two sessions share a keystream.
+func (hs *handshake) sessionKey(peer *hello) ([]byte, error) {
+	shared, err := curve25519.X25519(hs.priv, peer.pub)
+	if err != nil {
+		return nil, err
+	}
+
+	info := []byte("gole-session")
+	if bytes.Compare(hs.nonce, peer.nonce) < 0 {
+		info = append(append(info, hs.nonce...), peer.nonce...)
+	} else {
+		info = append(append(info, peer.nonce...), hs.nonce...)
+	}
+
+	k := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, hs.psk, info), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Send a length-prefixed handshake message over a stream.
+func writeHello(w io.Writer, h *hello) error {
+	b := h.marshal()
+	hdr := []byte{0, 0}
+	binary.BigEndian.PutUint16(hdr, uint16(len(b)))
+	_, err := w.Write(append(hdr, b...))
+	return err
+}
+
+// Receive a length-prefixed handshake message from a stream.
+func readHello(r io.Reader) (*hello, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	sz := int(binary.BigEndian.Uint16(hdr))
+	if sz > helloMaxSize {
+		return nil, errAuthKey
+	}
+	b := make([]byte, sz)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return parseHello(b)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func testHandshake(t *testing.T, key string) *handshake {
+	t.Helper()
+	hs, err := newHandshake(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs
+}
+
+// @a answers @b's challenge, then @b checks the answer as it arrives
+func answerTo(a, b *handshake) error {
+	okay, err := parseHello(a.okay(b.hello()).marshal())
+	if err != nil {
+		return err
+	}
+	return b.checkOkay(okay)
+}
+
+func TestHandshakeKey(t *testing.T) {
+	a, b := testHandshake(t, "secret"), testHandshake(t, "secret")
+	if err := answerTo(a, b); err != nil {
+		t.Fatal("same key:", err)
+	}
+	c := testHandshake(t, "other")
+	if err := answerTo(c, b); err != errAuthKey {
+		t.Fatalf("wrong key: %v, want %v", err, errAuthKey)
+	}
+	if err := answerTo(testHandshake(t, ""), b); err != errAuthKey {
+		t.Fatalf("no key: %v, want %v", err, errAuthKey)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	b := testHandshake(t, "secret").hello().marshal()
+	b[4] = protoVersion + 1
+	if _, err := parseHello(b); !errors.Is(err, errAuthVersion) {
+		t.Fatalf("%v, want %v", err, errAuthVersion)
+	}
+}
+
+func TestHandshakeOwnHello(t *testing.T) {
+	a := testHandshake(t, "secret")
+	if err := a.checkHello(a.hello()); !errors.Is(err, errAuthPeer) {
+		t.Fatalf("%v, want %v", err, errAuthPeer)
+	}
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := testHandshake(t, ""), testHandshake(t, "")
+	a.identity = priv
+	b.authorized = []ed25519.PublicKey{pub}
+	if err := answerTo(a, b); err != nil {
+		t.Fatal("authorized:", err)
+	}
+
+	// a signature that doesn't cover this exchange
+	okay := a.okay(b.hello())
+	okay.sig[0] ^= 1
+	if err := b.checkOkay(okay); !errors.Is(err, errAuthIdentity) {
+		t.Fatalf("bad signature: %v, want %v", err, errAuthIdentity)
+	}
+
+	// someone else's identity, or none at all
+	b.authorized = []ed25519.PublicKey{other}
+	if err := answerTo(a, b); !errors.Is(err, errAuthPeer) {
+		t.Fatalf("unknown identity: %v, want %v", err, errAuthPeer)
+	}
+	if err := answerTo(testHandshake(t, ""), b); !errors.Is(err, errAuthIdentity) {
+		t.Fatalf("no identity: %v, want %v", err, errAuthIdentity)
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"os"
 	"net"
 	"fmt"
 	"time"
 	"math/rand"
 	"sync"
-	"context"
 	"errors"
-
-	"golang.org/x/net/ipv4"
+	"context"
 )
 
-// wrapper for PunchTCP() and PunchUDP()
+var errPunchTimeout = errors.New("timeout punching holes")
+
+const tcpDialTimeout = 3 * time.Second
+const punchMaxTries = 60 // HELO rounds 1-3s apart, ~2mins
+const tcpTTLRestore = 100 * time.Millisecond // after the low ttl SYN
+
+// wrapper for PunchTCP() and PunchUDP(), udp falls back to the relay if any
 func Punch(conf Config) (net.Conn, error) {
 	var conn net.Conn
 	var err error
@@ -21,221 +24,734 @@ func Punch(conf Config) (net.Conn, error) {
 	case "tcp":
 		conn, err = PunchTCP(conf.(*TCPConfig))
 	case "udp":
-		conn, err = PunchUDP(conf.(*UDPConfig))
+		c := conf.(*UDPConfig)
+		conn, err = PunchUDP(c)
+		if errors.Is(err, errPunchTimeout) && c.Relay != nil {
+			perror("Failed to punch hole, falling back to relay.", err)
+			conn, err = RelayUDP(c)
+		}
 	}
 	return conn, err
 }
 
 func PunchTCP(conf *TCPConfig) (net.Conn, error) {
-	var conn net.Conn
 	var err error
-	var thru bool = false
 
-	// ~2mins timeout on retries
-	for i:=0; i<60; i++ {
-		conn, err = net.DialTCP("tcp", conf.LAddr, conf.RAddr)
-		if (err != nil) {
-			ms := 1000+rand.Intn(2000)
-			perror(fmt.Sprintf("connect: failed, retry in %.2fs.", float32(ms)/1000), err);
-			time.Sleep(time.Duration(ms)*time.Millisecond);
-			continue
+	if conf.PortMap != nil {
+		startPortMap(conf.PortMap, "tcp", conf.LAddr.Port)
+	}
+
+	if len(conf.STUN) > 0 {
+		stunDiscover(conf.STUN, func(server string) (net.Addr, error) {
+			addr, err := stunQueryTCP(conf.LAddr, server)
+			if err != nil {
+				return nil, err
+			}
+			return addr, nil
+		})
+	}
+
+	// conf is left as given, -persist punches with it again
+	raddr := conf.RAddr
+	if conf.Rendezvous != nil {
+		raddr, err = rendezvousTCP(conf.LAddr, conf.Rendezvous)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	ttl := conf.TTL
+	if ttl == ttlAuto {
+		ttl = autoTTL(&net.UDPAddr{IP: raddr.IP, Port: raddr.Port, Zone: raddr.Zone})
+	}
 
-		// encrypt socket
-		if conf.Key != "" {
-			conn = NewEConn(conn, conf.Enc, conf.Key)
+	// listen and dial on the same port, whichever connects first wins;
+	// local address may still be held by the STUN or rendezvous query
+	lc := net.ListenConfig{Control: reuseControl}
+	lis, err := lc.Listen(context.Background(), "tcp", conf.LAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	conns := make(chan net.Conn)
+	stop := make(chan struct{})
+	failed := make(chan struct{})
+	defer close(stop)
+	defer lis.Close()
+
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			if !c.RemoteAddr().(*net.TCPAddr).IP.Equal(raddr.IP) {
+				PrintDbgf("ignore connection from %s\n", c.RemoteAddr())
+				c.Close()
+				continue
+			}
+			fmt.Printf("accepted: %s\n", c.RemoteAddr())
+			select {
+			case conns <- c:
+			case <-stop:
+				c.Close()
+			}
+			return
 		}
+	}()
 
-		msg := fmt.Sprintf("HELO-%d", os.Getpid())
-		PrintDbgf("send: %s\n", msg);
-		_, err = conn.Write([]byte(msg))
-		if (err != nil) {
-			perror("send() failed.", err)
-			return nil, err
+	// SYNs with a low ttl open our NAT's mapping but never reach the
+	// peer's NAT, the peer's SYNs then come in through our listener
+	v6 := isIPv6(raddr)
+	dialer := &net.Dialer{LocalAddr: conf.LAddr, Control: reuseControl, Timeout: tcpDialTimeout}
+	if ttl != 0 {
+		dialer.Control = ttlControl(v6, ttl, tcpTTLRestore)
+		fmt.Printf("Set ttl to %d\n", ttl)
+	}
+	go func() {
+		// ~2mins timeout on retries
+		for i:=0; i<60; i++ {
+			c, err := dialer.Dial("tcp", raddr.String())
+			if err == nil {
+				select {
+				case conns <- c:
+				case <-stop:
+					c.Close()
+				}
+				return
+			}
+			ms := 1000+rand.Intn(2000)
+			perror(fmt.Sprintf("connect: failed, retry in %.2fs.", float32(ms)/1000), err);
+			select {
+			case <-time.After(time.Duration(ms)*time.Millisecond):
+			case <-stop:
+				return
+			}
 		}
+		close(failed)
+	}()
 
-		data := make([]byte, 1024)
-		n, err := conn.Read(data)
-		if err != nil {
-			perror("recv() failed.", err)
-			return nil, err
+	select {
+	case conn := <-conns:
+		return handshakeTCP(conn, conf)
+	case <-failed:
+		return nil, errPunchTimeout
+	}
+}
+
+// Mutual challenge-response over a freshly connected socket,
+// returns the socket encrypted with the session key.
+func handshakeTCP(conn net.Conn, conf *TCPConfig) (net.Conn, error) {
+	hs, err := newHandshake(conf.Key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hs.identity, hs.authorized = conf.Identity, conf.AuthPeers
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = fmt.Errorf("%w (handshake timed out)", errAuthKey)
+		} else if err == errRecordAuth || err == errRecordSize {
+			err = errAuthKey
 		}
-		fmt.Printf("recv: %s\n", data[:n])
+		return nil, err
+	}
 
-		// check authentication
-		if string(data[:4]) != "HELO" {
-			conn.Close()
-			return nil, errors.New("auth failed")
+	// encrypt socket
+	raw := conn
+	if conf.Key != "" {
+		conn = NewEConn(raw, conf.Enc, conf.Key)
+	}
+	conn = NewObfsConn(conn, conf.Obfs)
+	raw.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// send our challenge
+	msg := hs.hello()
+	PrintDbgf("send: %s\n", msg);
+	if err = writeHello(conn, msg); err != nil {
+		perror("send() failed.", err)
+		return fail(err)
+	}
+	peer, err := readHello(conn)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Printf("recv: %s\n", peer)
+	if peer.magic != "HELO" {
+		return fail(errAuthPeer)
+	}
+	if err = hs.checkHello(peer); err != nil {
+		return fail(err)
+	}
+
+	// answer peer's challenge and verify its answer to ours
+	msg = hs.okay(peer)
+	PrintDbgf("send: %s\n", msg);
+	if err = writeHello(conn, msg); err != nil {
+		perror("send() failed.", err)
+		return fail(err)
+	}
+	peer, err = readHello(conn)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Printf("recv: %s\n", peer)
+	if peer.magic != "OKAY" {
+		return fail(errAuthPeer)
+	}
+	if err = hs.checkOkay(peer); err != nil {
+		return fail(err)
+	}
+	// our OKAY may still be merging, it has to go out before the next layer
+	if oc, ok := conn.(*ObfsConn); ok {
+		if err = oc.Flush(); err != nil {
+			return fail(err)
 		}
+	}
+	raw.SetDeadline(time.Time{})
 
-		thru = true
-		break
+	k, err := hs.sessionKey(peer)
+	if err != nil {
+		return fail(err)
 	}
 
-	if !thru {
-		return nil, errors.New("timeout punching holes")
+	// replace our own encryption with TLS, still obfuscated on top
+	if conf.TLS != nil {
+		tconn, err := tlsHandshake(raw, conf.TLS, conf.Op == "client", k)
+		if err != nil {
+			return fail(err)
+		}
+		return NewObfsConn(tconn, conf.Obfs), nil
 	}
-	return conn, err
+
+	// switch to per-session key
+	conn = raw
+	if hs.encrypts(peer) {
+		conn = newEConnKey(raw, conf.Enc, k)
+	}
+	return NewObfsConn(conn, conf.Obfs), nil
 }
 
-func sendMsgUDP(conn net.PacketConn, msg string, to_addr net.Addr) error {
-	PrintDbgf("send: %s\n", msg);
-	_, err := conn.WriteTo([]byte(msg), to_addr)
+func sendMsgUDP(conn net.PacketConn, msg *hello, to_addr net.Addr) error {
+	PrintDbgf("send: %s to %s\n", msg, to_addr);
+	_, err := conn.WriteTo(msg.marshal(), to_addr)
 	if (err != nil) {
 		perror("send() failed.", err)
 	}
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	return err
 }
 
-func PunchUDP(conf *UDPConfig) (net.Conn, error) {
-	var conn net.PacketConn
-	var err error
-	var ttl0 int
-	var opts *ipv4.Conn
+// A local socket taking part in UDP punching.
+type punchSocket struct {
+	raw net.PacketConn
+	conn net.PacketConn // raw with handshake encryption and obfuscation
+	openers map[string]packetOpener // by remote address, receiver only
+}
 
-	// conn, err = net.DialUDP("udp", conf.LAddr, conf.RAddr)
-	conn, err = net.ListenUDP("udp", conf.LAddr)
-	if err != nil {
-		perror("net.DialUDP() failed.", err)
-		os.Exit(1)
+// A path between one of our sockets and a remote address.
+type punchPair struct {
+	sock *punchSocket
+	addr *net.UDPAddr
+	helo bool // peer's HELO answered on this path
+	peer *hello // peer's verified answer to our challenge
+	prio uint32 // remote candidate priority, with candidates only
+}
+
+// Punches every local socket towards every target at once, the first path
+// that completes the handshake both ways wins. With more than one possible
+// path, the controlling side nominates the winner with a PICK.
+type udpPuncher struct {
+	hs *handshake
+	conf *UDPConfig
+	socks []*punchSocket
+	targets []*net.UDPAddr
+	loose bool // accept replies from any port of a target's host
+	onRecv func() // called once on the first authenticated message
+	skip func([]byte) bool // drops datagrams that aren't part of the handshake
+	cands map[string]candidate // remote candidates by address, nil without
+
+	mu sync.Mutex
+	pairs map[string]*punchPair
+	won *punchPair
+	best *punchPair // best working path yet, controlling side only
+	nominating bool
+	fail error
+	rejected int // datagrams from a target that failed authentication
+	rejectErr error
+	done chan struct{} // closed once won or failed
+	stop chan struct{} // closed to stop the receivers
+	once sync.Once
+	recvOnce sync.Once
+}
+
+func newUDPPuncher(hs *handshake, conf *UDPConfig) *udpPuncher {
+	return &udpPuncher{
+		hs: hs,
+		conf: conf,
+		pairs: make(map[string]*punchPair),
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
 	}
+}
 
-	var wg sync.WaitGroup
-	var fail error = nil
-	recv_done := make(chan struct{})
-	ctx1, sendDone := context.WithCancel(context.Background())
-
-	// set ttl
-	if conf.TTL != 0 {
-		opts = ipv4.NewConn(conn.(*net.UDPConn))
-		ttl0, err = opts.TTL()
-		if err != nil {
-			perror("Get TTL failed.", err)
+// add a socket, encrypted with the pre-shared key for the handshake
+func (pu *udpPuncher) add(raw net.PacketConn) {
+	pu.socks = append(pu.socks, &punchSocket{
+		raw: raw,
+		conn: pu.wrap(raw),
+		openers: make(map[string]packetOpener),
+	})
+}
+
+func (pu *udpPuncher) wrap(raw net.PacketConn) net.PacketConn {
+	conn := raw
+	if pu.conf.Key != "" {
+		switch raw.(type) {
+		case *net.UDPConn:
+			conn = newEPacketConnKey(raw, pu.conf.Enc, pu.hs.psk)
 		}
-		err = opts.SetTTL(conf.TTL)
-		if err != nil {
-			perror("Set TTL failed.", err)
-		} else {
-			fmt.Printf("Set ttl to %d\n", conf.TTL)
+	}
+	return NewObfsPacketConn(conn, pu.conf.Obfs)
+}
+
+// Verifies datagrams from @addr on @s, nil if they aren't encrypted. Each of
+// the peer's sockets counts its own sequence numbers, so each remote address
+// needs a replay window of its own.
+func (pu *udpPuncher) opener(s *punchSocket, addr *net.UDPAddr) packetOpener {
+	o, ok := s.openers[addr.String()]
+	if !ok {
+		o, _ = pu.wrap(s.raw).(packetOpener)
+		s.openers[addr.String()] = o
+	}
+	return o
+}
+
+// Check remote candidates in priority order, those a socket on @laddr
+// can't reach are left out.
+func (pu *udpPuncher) setCandidates(laddr *net.UDPAddr, cands []candidate) {
+	pu.cands = make(map[string]candidate)
+	pu.targets = nil
+	for _, c := range sortCandidates(cands) {
+		if reachable(laddr, c.addr) {
+			pu.cands[c.addr.String()] = c
+			pu.targets = append(pu.targets, c.addr)
 		}
 	}
+}
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.UDPConn:
-			conn = NewEPacketConn(conn, conf.Enc, conf.Key)
+// candidate for a remote address, peer reflexive if we weren't told of it
+func (pu *udpPuncher) candidate(addr *net.UDPAddr) candidate {
+	if c, ok := pu.cands[addr.String()]; ok {
+		return c
+	}
+	return candidate{candPrflx, addr}
+}
+
+func (pu *udpPuncher) multi() bool {
+	return pu.loose || len(pu.socks)*len(pu.targets) > 1
+}
+
+func (pu *udpPuncher) accepts(addr *net.UDPAddr) bool {
+	for _, t := range pu.targets {
+		if t.IP.Equal(addr.IP) && (pu.loose || pu.cands != nil || t.Port == addr.Port) {
+			return true
 		}
 	}
+	return false
+}
 
-	// sender
-	msg := fmt.Sprintf("HELO-%d", os.Getpid())
-	wg.Add(1)
-	go func() {
-		defer PrintDbgf("sender stopped\n")
-		defer wg.Done()
+// caller must hold pu.mu
+func (pu *udpPuncher) pair(s *punchSocket, addr *net.UDPAddr) *punchPair {
+	key := s.raw.LocalAddr().String() + "|" + addr.String()
+	p := pu.pairs[key]
+	if p == nil {
+		p = &punchPair{sock: s, addr: addr}
+		if pu.cands != nil {
+			p.prio = pu.candidate(addr).priority()
+		}
+		pu.pairs[key] = p
+	}
+	return p
+}
 
-		// ~2mins timeout on retries
-		for i:=1; i<=60; i++ {
-			err = sendMsgUDP(conn, msg, conf.RAddr)
-			ms := time.Duration(1000+rand.Intn(2000))
-			select {
-			case <-time.After(ms*time.Millisecond):
-			case <-ctx1.Done():
-				return
+func (pu *udpPuncher) finish(p *punchPair, err error) {
+	pu.once.Do(func() {
+		pu.won, pu.fail = p, err
+		close(pu.done)
+	})
+}
+
+func (pu *udpPuncher) send() {
+	defer PrintDbgf("sender stopped\n")
+	msg := pu.hs.hello()
+
+	tries := pu.conf.punchTries
+	if tries == 0 {
+		tries = punchMaxTries
+	}
+	for i:=1; i<=tries; i++ {
+		n := 0
+		for _, s := range pu.socks {
+			for _, t := range pu.targets {
+				select {
+				case <-pu.done:
+					return
+				default:
+				}
+				if pu.multi() {
+					s.conn.WriteTo(msg.marshal(), t)
+				} else {
+					sendMsgUDP(s.conn, msg, t)
+				}
+				if n++; n%64 == 0 {
+					time.Sleep(time.Millisecond) // don't flood the NAT
+				}
 			}
-			if i == 60 {
-				PrintDbgf("send: failed.\n")
-				fail = errors.New("timeout punching holes")
-				close(recv_done)
-				conn.SetReadDeadline(time.Now())
-				return
+		}
+		if pu.multi() {
+			PrintDbgf("send: %s to %d targets from %d sockets\n", msg, len(pu.targets), len(pu.socks))
+		}
+
+		ms := time.Duration(1000+rand.Intn(2000))
+		select {
+		case <-time.After(ms*time.Millisecond):
+		case <-pu.done:
+			return
+		}
+		if i == tries {
+			PrintDbgf("send: failed.\n")
+			pu.finish(nil, pu.timeoutErr())
+		} else {
+			PrintDbgf("send: timeout, retry\n")
+		}
+	}
+}
+
+func (pu *udpPuncher) receive(s *punchSocket) {
+	defer PrintDbgf("receiver stopped\n")
+	data := make([]byte, 2048)
+	for {
+		s.raw.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, raddr, err := s.raw.ReadFrom(data)
+		select {
+		case <-pu.stop:
+			return
+		default:
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			perror("recv: failed.", err)
+			pu.finish(nil, err)
+			return
+		}
+		addr, ok := raddr.(*net.UDPAddr)
+		if !ok || !pu.accepts(addr) {
+			fmt.Printf("ignore unsolicited message from %s\n", raddr)
+			continue
+		}
+		if pu.skip != nil && pu.skip(data[:n]) {
+			continue
+		}
+
+		// decrypt
+		if opener := pu.opener(s, addr); opener != nil {
+			n, err = opener.Open(data, data[:n])
+			if err == errPacketReplay {
+				continue
+			} else if err != nil {
+				pu.reject(addr, errAuthKey)
+				continue
+			}
+		}
+
+		// check authentication
+		h, err := parseHello(data[:n])
+		if err == nil {
+			fmt.Printf("recv: %s from %s\n", h, addr)
+			if h.magic == "HELO" {
+				err = pu.hs.checkHello(h)
 			} else {
-				PrintDbgf("send: timeout, retry\n")
+				err = pu.hs.checkOkay(h)
 			}
 		}
-	}()
+		if errors.Is(err, errAuthKey) || errors.Is(err, errAuthPeer) {
+			pu.reject(addr, err)
+			continue
+		} else if err != nil {
+			pu.finish(nil, err)
+			return
+		}
+		if pu.onRecv != nil {
+			pu.recvOnce.Do(pu.onRecv)
+		}
+		pu.handle(s, addr, h)
+	}
+}
+
+// Drop a datagram that fails authentication, it may be a stray or left
+// over from an old session. Only reported if the punch times out.
+func (pu *udpPuncher) reject(addr *net.UDPAddr, err error) {
+	pu.mu.Lock()
+	pu.rejected++
+	pu.rejectErr = err
+	pu.mu.Unlock()
+	PrintDbgf("drop datagram from %s: %v\n", addr, err)
+}
 
-	// receiver
-	wg.Add(2)
+func (pu *udpPuncher) timeoutErr() error {
+	pu.mu.Lock()
+	defer pu.mu.Unlock()
+	if pu.rejected > 0 {
+		return fmt.Errorf("%v, %d datagrams from the peer rejected: %w", pu.rejectErr, pu.rejected, errPunchTimeout)
+	}
+	return errPunchTimeout
+}
+
+func (pu *udpPuncher) handle(s *punchSocket, addr *net.UDPAddr, h *hello) {
+	pu.mu.Lock()
+	defer pu.mu.Unlock()
+	p := pu.pair(s, addr)
+	switch h.magic {
+	case "HELO":
+		sendMsgUDP(s.conn, pu.hs.okay(h), addr)
+		p.helo = true
+	case "OKAY", "PICK":
+		p.peer = h
+	}
+	if p.peer == nil {
+		return
+	}
+
+	if h.magic == "PICK" {
+		pu.finish(p, nil)
+	} else if p.helo && pu.hs.controlling(p.peer) && pu.cands != nil {
+		pu.nominate(p)
+	} else if p.helo && pu.hs.controlling(p.peer) {
+		sendMsgUDP(s.conn, pu.hs.pick(p.peer), addr)
+		pu.finish(p, nil)
+	} else if p.helo && !pu.multi() {
+		pu.finish(p, nil)
+	}
+}
+
+// Nominate the best working path, right away if nothing can beat @p or
+// after giving better paths a moment to come through. Caller must hold pu.mu.
+func (pu *udpPuncher) nominate(p *punchPair) {
+	select {
+	case <-pu.done:
+		return
+	default:
+	}
+	if pu.best == nil || p.prio > pu.best.prio {
+		pu.best = p
+		PrintDbgf("ice: %s works, priority %d\n", pu.candidate(p.addr), p.prio)
+	}
+	pick := func() {
+		select {
+		case <-pu.done:
+			return
+		default:
+		}
+		sendMsgUDP(pu.best.sock.conn, pu.hs.pick(pu.best.peer), pu.best.addr)
+		pu.finish(pu.best, nil)
+	}
+	if len(pu.targets) > 0 && pu.best.prio >= pu.candidate(pu.targets[0]).priority() {
+		pick()
+	} else if !pu.nominating {
+		pu.nominating = true
+		time.AfterFunc(iceNominateWait, func() {
+			pu.mu.Lock()
+			defer pu.mu.Unlock()
+			pick()
+		})
+	}
+}
+
+func (pu *udpPuncher) run() (*punchPair, error) {
+	var wg sync.WaitGroup
+	for _, s := range pu.socks {
+		wg.Add(1)
+		go func(s *punchSocket) {
+			defer wg.Done()
+			pu.receive(s)
+		}(s)
+	}
+	wg.Add(1)
 	go func() {
-		helo, okay := false, false
-		defer func() {
-			PrintDbgf("receiver stopped\n")
-			if ! helo { wg.Done() }
-			if ! okay { wg.Done() }
-			conn.SetReadDeadline(time.Time{})
-		}()
+		defer wg.Done()
+		pu.send()
+	}()
 
-		for {
-			data := make([]byte, 1024)
-			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			n, raddr, err := conn.ReadFrom(data)
-			select {
-			case <-recv_done:
-				return
-			default:
-			}
-			if raddr.String() != conf.RAddr.String() {
-				fmt.Printf("ignore unsolicited message from %s\n", raddr)
-				continue
+	<-pu.done
+	if pu.won != nil {
+		// keep answering and nominating while the peer catches up
+		PrintDbgf("Wait for remaining packets to clear ...\n")
+		for i:=0; i<4; i++ {
+			time.Sleep(500 * time.Millisecond)
+			pu.mu.Lock()
+			if pu.hs.controlling(pu.won.peer) {
+				sendMsgUDP(pu.won.sock.conn, pu.hs.pick(pu.won.peer), pu.won.addr)
 			}
+			pu.mu.Unlock()
+		}
+	}
+	close(pu.stop)
+	wg.Wait()
+	for _, s := range pu.socks {
+		s.raw.SetReadDeadline(time.Time{})
+	}
+	return pu.won, pu.fail
+}
+
+func PunchUDP(conf *UDPConfig) (net.Conn, error) {
+	var conn *net.UDPConn
+	var err error
+	var ttl0 int
+
+	// conn, err = net.DialUDP("udp", conf.LAddr, conf.RAddr)
+	conn, err = net.ListenUDP("udp", conf.LAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	var pmapped *net.UDPAddr
+	if conf.PortMap != nil {
+		if ip, port := startPortMap(conf.PortMap, "udp", laddr.Port); ip != nil {
+			pmapped = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+
+	var mapped []net.Addr
+	if len(conf.STUN) > 0 {
+		mapped = stunDiscover(conf.STUN, func(server string) (net.Addr, error) {
+			addr, err := stunQueryUDP(conn, server)
 			if err != nil {
-				perror("recv: failed.", err)
-				fail = err
-				sendDone()
-				return
+				return nil, err
 			}
-			fmt.Printf("recv: %s\n", data[:n])
+			return addr, nil
+		})
+	}
+	local := gatherCandidates(laddr, mapped, pmapped)
+	fmt.Printf("candidates: %s\n", joinCandidates(local, ","))
+	// conf is left as given, -persist and the relay punch with it again
+	raddr, cands := conf.RAddr, conf.Cands
+	if conf.Rendezvous != nil {
+		raddr, cands, err = rendezvousUDP(conn, conf.Rendezvous, local)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
-			if n < 4 {
-				continue
+	hs, err := newHandshake(conf.Key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hs.identity, hs.authorized = conf.Identity, conf.AuthPeers
+
+	pu := newUDPPuncher(hs, conf)
+	pu.add(conn)
+	pu.targets = []*net.UDPAddr{raddr}
+	if len(cands) > 1 {
+		pu.setCandidates(laddr, cands)
+		fmt.Printf("ice: checking %d remote candidates\n", len(pu.targets))
+	}
+
+	// spray predicted ports, from many sockets if our NAT is random
+	if conf.Predict != nil {
+		pat := probeNAT(conf.LAddr, conf.STUN, mapped)
+		fmt.Printf("nat: %s\n", pat)
+		sockets := 1
+		if pat.kind == natRandom || pat.kind == natUnknown {
+			sockets = conf.Predict.Sockets
+		}
+		for i:=1; i<sockets; i++ {
+			c, err := net.ListenUDP("udp", &net.UDPAddr{IP: conf.LAddr.IP, Zone: conf.LAddr.Zone})
+			if err != nil {
+				perror("net.ListenUDP() failed.", err)
+				break
+			}
+			pu.add(c)
+		}
+		// the peer's step if given, otherwise guess it steps like our NAT
+		step := conf.Predict.Step
+		if step == 0 {
+			step = 1
+			if pat.kind == natIncremental {
+				step = pat.delta
 			}
+		}
+		pu.targets = append(pu.targets, predictPorts(raddr, conf.Predict.Range, step)...)
+		pu.loose = true
+		fmt.Printf("predict: spraying %d remote ports from %d local sockets\n", len(pu.targets), len(pu.socks))
+	}
 
-			// check authentication
-			if !contains(string(data[:4]), []string{"HELO", "OKAY"}) {
-				fail = errors.New("auth failed")
-				sendDone()
-				return
+	// set ttl, on every socket punching
+	ttl := conf.TTL
+	if ttl == ttlAuto {
+		ttl = autoTTL(raddr)
+	}
+	if ttl != 0 {
+		v6 := isIPv6(raddr)
+		ttl0, err = getTTL(conn, v6)
+		if err != nil {
+			perror("Get TTL failed.", err)
+		}
+		for _, s := range pu.socks {
+			err = setTTL(s.raw.(net.Conn), v6, ttl)
+			if err != nil {
+				perror("Set TTL failed.", err)
+				break
 			}
+		}
+		if err == nil {
+			fmt.Printf("Set ttl to %d\n", ttl)
+		}
 
-			// restore ttl
-			if conf.TTL != 0 {
-				err = opts.SetTTL(ttl0)
-				if err != nil {
+		// restore ttl
+		pu.onRecv = func() {
+			for _, s := range pu.socks {
+				if err := setTTL(s.raw.(net.Conn), v6, ttl0); err != nil {
 					perror("Restore TTL failed.", err)
 				}
 			}
+		}
+	}
 
-			switch string(data[:4]) {
-			case "HELO":
-				sendMsgUDP(conn, "OKAY", conf.RAddr)
-				if ! helo {
-					helo = true
-					wg.Done()
-				}
-			case "OKAY":
-				sendDone()
-				if ! okay {
-					okay = true
-					wg.Done()
-				}
-			}
-		} // for
-	}()
+	p, err := pu.run()
+	for _, s := range pu.socks {
+		if p == nil || s != p.sock {
+			s.raw.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pu.cands != nil {
+		fmt.Printf("ice: nominated %s\n", pu.candidate(p.addr))
+	} else if p.addr.String() != raddr.String() || p.sock.raw != conn {
+		fmt.Printf("predict: punched through %s <--> %s\n", p.sock.raw.LocalAddr(), p.addr)
+	}
+	conf.peer = p.addr
 
-	wg.Wait()
-	close(recv_done) // stop receiver
-	conn.SetReadDeadline(time.Now()) // cancel ReadFrom()
-	time.Sleep(10)
-	PrintDbgf("Wait for remaining packets to clear ...\n")
-	time.Sleep(2*time.Second) // wait for packets to clear
-	if fail != nil {
-		conn.Close()
-		return nil, fail
+	k, err := hs.sessionKey(p.peer)
+	if err != nil {
+		p.sock.raw.Close()
+		return nil, err
 	}
-	return conn.(net.Conn), nil
+	conf.sessKey = k
+	return sessionConnUDP(p.sock.raw, conf, k, hs.encrypts(p.peer)).(net.Conn), nil
 }
 
-
+// switch @raw to the per-session key, if @encrypt
+func sessionConnUDP(raw net.PacketConn, conf *UDPConfig, k []byte, encrypt bool) net.PacketConn {
+	pconn := raw
+	if encrypt {
+		pconn = newEPacketConnKey(raw, conf.Enc, k)
+	}
+	return NewObfsPacketConn(pconn, conf.Obfs)
+}
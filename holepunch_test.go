@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPunchTimeoutErr(t *testing.T) {
+	pu := &udpPuncher{}
+	if err := pu.timeoutErr(); err != errPunchTimeout {
+		t.Fatalf("timeoutErr() = %v, want %v", err, errPunchTimeout)
+	}
+
+	// rejected datagrams are reported, the error still reads as a timeout
+	// so the relay fallback kicks in
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4444}
+	pu.reject(addr, errAuthKey)
+	pu.reject(addr, errAuthKey)
+	err := pu.timeoutErr()
+	if !errors.Is(err, errPunchTimeout) {
+		t.Fatalf("timeoutErr() = %v, not a timeout", err)
+	}
+	if !strings.Contains(err.Error(), errAuthKey.Error()) || !strings.Contains(err.Error(), "2 datagrams") {
+		t.Fatalf("timeoutErr() = %q", err)
+	}
+}
+
+func TestHandshakeTCPMergeTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// the client's HELO goes out alone, its OKAY is still held back when
+	// the server's arrives
+	obfs := &ObfsConfig{Merge: 300 * time.Millisecond}
+	type result struct {
+		conn net.Conn
+		err error
+	}
+	srvc := make(chan result, 1)
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			srvc <- result{nil, err}
+			return
+		}
+		time.Sleep(2 * obfs.Merge)
+		conf := &TCPConfig{Op: "server", Enc: "xor", Key: "k", Obfs: &ObfsConfig{}, TLS: &TLSConfig{Self: true}}
+		conn, err := handshakeTCP(raw, conf)
+		srvc <- result{conn, err}
+	}()
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &TCPConfig{Op: "client", Enc: "xor", Key: "k", Obfs: obfs, TLS: &TLSConfig{}}
+	cli, err := handshakeTCP(raw, conf)
+	if err != nil {
+		t.Fatal("client:", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	r := <-srvc
+	if r.err != nil {
+		t.Fatal("server:", r.err)
+	}
+	t.Cleanup(func() { r.conn.Close() })
+
+	// the tunnel works on top of both TLS and the merging
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(r.conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
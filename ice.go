@@ -0,0 +1,153 @@
+package main
+//
+// ICE-style candidates (RFC 8445): gathering, exchange and priorities
+//
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	candHost = "host" // address of one of our interfaces
+	candPrflx = "prflx" // learned from where the peer's HELO came from
+	candMapped = "mapped" // port mapped on the router, see -portmap
+	candSrflx = "srflx" // public address seen by a STUN or rendezvous server
+
+	iceNominateWait = 1 * time.Second // how long to wait for a better path
+	iceMaxCandidates = 16
+)
+
+var candTypePref = map[string]uint32{
+	candHost: 126,
+	candPrflx: 110,
+	candMapped: 105,
+	candSrflx: 100,
+}
+
+type candidate struct {
+	typ string
+	addr *net.UDPAddr
+}
+func (c candidate) String() string {
+	return c.typ + "/" + c.addr.String()
+}
+
+// RFC 8445 5.1.2.1 with a single component, IPv6 ahead of IPv4
+func (c candidate) priority() uint32 {
+	local := uint32(65534)
+	if isIPv6(c.addr) {
+		local = 65535
+	}
+	return candTypePref[c.typ]<<24 | local<<8 | 255
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 || (ip4[0] == 172 && ip4[1]&0xf0 == 16) || (ip4[0] == 192 && ip4[1] == 168)
+	}
+	return ip[0]&0xfe == 0xfc // fc00::/7
+}
+
+// Params:
+//   [type/]ip:port
+// Untyped addresses are host candidates if private, srflx otherwise.
+func parseCandidate(s string) (candidate, error) {
+	var c candidate
+	if i := strings.Index(s, "/"); i >= 0 {
+		c.typ, s = s[:i], s[i+1:]
+		if _, ok := candTypePref[c.typ]; !ok {
+			return c, errors.New("unknown candidate type " + c.typ)
+		}
+	}
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		return c, err
+	}
+	c.addr = addr
+	if c.typ == "" {
+		c.typ = candSrflx
+		if isPrivateIP(addr.IP) {
+			c.typ = candHost
+		}
+	}
+	return c, nil
+}
+
+// comma separated candidates, in the order given
+func parseCandidates(s string) ([]candidate, error) {
+	var cands []candidate
+	for _, v := range strings.Split(s, ",") {
+		c, err := parseCandidate(v)
+		if err != nil {
+			return nil, err
+		}
+		cands = append(cands, c)
+	}
+	return cands, nil
+}
+
+func joinCandidates(cands []candidate, sep string) string {
+	ss := make([]string, len(cands))
+	for i, c := range cands {
+		ss[i] = c.String()
+	}
+	return strings.Join(ss, sep)
+}
+
+// highest priority first, dropping duplicate addresses
+func sortCandidates(cands []candidate) []candidate {
+	sort.SliceStable(cands, func(i, j int) bool {
+		return cands[i].priority() > cands[j].priority()
+	})
+	var out []candidate
+	seen := make(map[string]bool)
+	for _, c := range cands {
+		if !seen[c.addr.String()] {
+			seen[c.addr.String()] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Our candidates for a socket bound to @laddr: its interface addresses,
+// then the public addresses STUN saw (@mapped) and the router mapped
+// (@pmapped, may be nil).
+func gatherCandidates(laddr *net.UDPAddr, mapped []net.Addr, pmapped *net.UDPAddr) []candidate {
+	var cands []candidate
+	if !isWildcard(laddr) {
+		cands = append(cands, candidate{candHost, laddr})
+	} else if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.IsLoopback() || ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			cands = append(cands, candidate{candHost, &net.UDPAddr{IP: ipn.IP, Port: laddr.Port}})
+		}
+	}
+	for _, a := range mapped {
+		if ua, ok := a.(*net.UDPAddr); ok {
+			cands = append(cands, candidate{candSrflx, ua})
+		}
+	}
+	if pmapped != nil {
+		cands = append(cands, candidate{candMapped, pmapped})
+	}
+	if cands = sortCandidates(cands); len(cands) > iceMaxCandidates {
+		cands = cands[:iceMaxCandidates]
+	}
+	return cands
+}
+
+// Whether a socket bound to @laddr can send to @raddr.
+func reachable(laddr, raddr *net.UDPAddr) bool {
+	return isWildcard(laddr) || isIPv6(laddr) == isIPv6(raddr)
+}
@@ -0,0 +1,114 @@
+package main
+//
+// Ed25519 peer identities
+//
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const identityKeyType = "gole-ed25519"
+
+// SSH style fingerprint of a public key
+func fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Generate a keypair, write private key to @path and public key to @path.pub
+func KeyGen(path string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	line := fmt.Sprintf("%s %s %s\n", identityKeyType, base64.StdEncoding.EncodeToString(pub), host)
+	if err = ioutil.WriteFile(path+".pub", []byte(line), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("private key: %s\n", path)
+	fmt.Printf("public key: %s.pub\n", path)
+	fmt.Printf("fingerprint: %s\n", fingerprint(pub))
+	return nil
+}
+
+// Load a private key written by KeyGen()
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no private key found in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 key: " + path)
+	}
+	return priv, nil
+}
+
+// Parse one public key line: "gole-ed25519 BASE64 [comment]"
+func parsePublicKey(line string) (ed25519.PublicKey, error) {
+	fs := strings.Fields(line)
+	if len(fs) < 2 || fs[0] != identityKeyType {
+		return nil, errors.New("malformed public key")
+	}
+	b, err := base64.StdEncoding.DecodeString(fs[1])
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed public key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// Load an authorized_peers file, one public key per line,
+// blank lines and lines starting with '#' are ignored.
+func loadAuthorizedPeers(path string) ([]ed25519.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var peers []ed25519.PublicKey
+	scanner := bufio.NewScanner(file)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pub, err := parsePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, ln, err)
+		}
+		peers = append(peers, pub)
+	}
+	return peers, scanner.Err()
+}
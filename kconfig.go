@@ -6,13 +6,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 
 	kcp "github.com/xtaci/kcp-go"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/hkdf"
 	"crypto/sha1"
+	"crypto/sha256"
 )
 
+// key shipped in kcp.conf of earlier releases, known to everyone
+const kcpDefaultKey = "somekey"
+
 type KCPConfig struct {
 	Key          string `json:"key"`
 	Crypt        string `json:"crypt"`
@@ -33,7 +39,7 @@ type KCPConfig struct {
 
 func getKCPConfig(path string) *KCPConfig {
 	kconf := KCPConfig{
-		"somekey",	// key
+		"",			// key, empty to derive from the session key
 		"xor",		// crypt
 		"fast2",	// mode
 		1350,		// mtu
@@ -78,8 +84,16 @@ func getKCPConfig(path string) *KCPConfig {
 	return &kconf
 }
 
-func getKCPBlockCipher(kconf *KCPConfig) kcp.BlockCrypt {
-	pass := pbkdf2.Key([]byte(kconf.Key), []byte("some salt"), 4096, 32, sha1.New)
+// Block cipher for KCP, keyed by kcp.conf's "key" if set, otherwise
+// derived from the session key negotiated while punching.
+func getKCPBlockCipher(kconf *KCPConfig, sessKey []byte) kcp.BlockCrypt {
+	var pass []byte
+	if kconf.Key != "" {
+		pass = pbkdf2.Key([]byte(kconf.Key), []byte("some salt"), 4096, 32, sha1.New)
+	} else {
+		pass = make([]byte, 32)
+		io.ReadFull(hkdf.New(sha256.New, sessKey, nil, []byte("gole-kcp")), pass)
+	}
 	var block kcp.BlockCrypt
 	switch kconf.Crypt {
 	case "sm4":
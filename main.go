@@ -2,7 +2,11 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -10,7 +14,18 @@ const VERSION string = "1.2.1"
 
 func main() {
 	fmt.Printf("Gole v%s\n", VERSION)
+	rand.Seed(time.Now().UnixNano())
 	conf := ParseConfig(os.Args)
+
+	// clean up on ctrl-c
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Printf("interrupted\n")
+		exit(1)
+	}()
+
 	switch conf.getMode() {
 	case "tcp":
 		fmt.Printf("tunnel mode: TCP\n")
@@ -23,34 +38,76 @@ func main() {
 		PrintDbgf("%v\n", conf.(*UDPConfig))
 	default:
 		fmt.Printf("not implemented\n")
-		os.Exit(1)
+		exit(1)
 	}
 
-	// punch hole
-	fmt.Println("====================")
-	fmt.Printf("punching holes: [local]%s ---> [remote]%s\n", conf.LocalAddr(), conf.RemoteAddr())
-	conn, err := Punch(conf)
-	if err != nil {
-		perror("Failed to punch hole.", err)
-		os.Exit(1)
-	}
-	fmt.Printf("punched through\n")
-	time.Sleep(50)
-	fmt.Printf("%s %s\n", conn.LocalAddr(), conf.RemoteAddr())
-	if conf.getOp() == "holepunch" {
-		os.Exit(0)
+	// punch hole, and again whenever the tunnel collapses with -persist
+	backoff := time.Second
+	wait := func(what string) {
+		fmt.Printf("%s in %s\n", what, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > persistMaxBackoff {
+			backoff = persistMaxBackoff
+		}
 	}
+	for {
+		fmt.Println("====================")
+		fmt.Printf("punching holes: [local]%s ---> [remote]%s\n", conf.LocalAddr(), conf.RemoteAddr())
+		conn, err := Punch(conf)
+
+		// mappings renew themselves until exit
+		switch c := conf.(type) {
+		case *TCPConfig:
+			c.PortMap = nil
+		case *UDPConfig:
+			c.PortMap = nil
+		}
+		if err != nil {
+			perror("Failed to punch hole.", err)
+			if !g_persist {
+				exit(1)
+			}
+			wait("punching again")
+			continue
+		}
+		fmt.Printf("punched through\n")
+		time.Sleep(50)
+		fmt.Printf("%s %s\n", conn.LocalAddr(), peerAddr(conn, conf))
+		if conf.getOp() == "holepunch" {
+			exit(0)
+		}
 
-	// create tunnel
-	fmt.Println("====================")
-	fmt.Printf("creating tunnel: [local]%s <--> [remote]%s\n", conn.LocalAddr(), conf.RemoteAddr())
+		// create tunnel
+		fmt.Println("====================")
+		fmt.Printf("creating tunnel: [local]%s <--> [remote]%s\n", conn.LocalAddr(), peerAddr(conn, conf))
 
-	if conf.getOp() == "client" {
-		fmt.Println("starting client ...")
-		StartClient(conn, conf)
-	} else if conf.getOp() == "server" {
-		fmt.Println("starting server ...")
-		StartServer(conn, conf)
+		start := time.Now()
+		if conf.getOp() == "client" {
+			fmt.Println("starting client ...")
+			StartClient(conn, conf)
+		} else if conf.getOp() == "server" {
+			fmt.Println("starting server ...")
+			StartServer(conn, conf)
+		}
+		if !g_persist {
+			break
+		}
+
+		// only a tunnel that held up for a while starts the backoff over
+		if time.Since(start) > persistMaxBackoff {
+			backoff = time.Second
+		}
+		wait("tunnel lost, punching again")
 	}
 	fmt.Printf("Done\n")
+	runExitHooks()
+}
+
+// where @conn was punched through to, the address in @conf may have been
+// left for the rendezvous or a predicted port
+func peerAddr(conn net.Conn, conf Config) net.Addr {
+	if c, ok := conf.(*UDPConfig); ok {
+		return c.peer
+	}
+	return conn.RemoteAddr()
 }
@@ -0,0 +1,324 @@
+package main
+//
+// NAT type detection against cooperating STUN servers
+//
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	natcheckTries = 3 // transmissions for tests that may legitimately fail
+	natcheckLifetimeStart = 5 * time.Second
+)
+
+type natReport struct {
+	local *net.UDPAddr
+	mapped *net.UDPAddr
+	nat bool // mapped address differs from the local one
+	symmetric bool
+	mapping string // how mapping was judged, or why it couldn't be
+	filtering string // "full", "restricted", "port-restricted", "" if unknown
+	pattern natPattern
+	hairpin bool
+	lifetime string
+}
+
+func (r *natReport) kind() string {
+	switch {
+	case !r.nat:
+		return "no NAT (public address)"
+	case r.symmetric:
+		return "symmetric"
+	case r.filtering != "":
+		return r.filtering + " cone"
+	}
+	return "cone, filtering unknown"
+}
+
+// How to punch through, given our own NAT type.
+func (r *natReport) recommend() []string {
+	switch {
+	case !r.nat:
+		return []string{"hole punching should just work, only the peer's NAT matters"}
+	case r.symmetric:
+		rec := []string{
+			"plain hole punching will likely fail, use -predict=on in 'udp' mode",
+			"if the peer is symmetric too, also set -ttl=auto (on one side only) so early HELOs don't burn the peer's mappings",
+			"'tcp' mode is unlikely to punch through, prefer 'udp' with -proto=kcp",
+		}
+		if r.pattern.kind == natRandom {
+			rec = append(rec, "ports are random, raise -predict sockets=N for better odds")
+		}
+		return rec
+	case r.filtering == "full":
+		return []string{"hole punching should just work, -ttl and -predict are not needed"}
+	case r.filtering == "restricted" || r.filtering == "restricted or full":
+		return []string{"hole punching works with any peer that is not symmetric, -ttl is not needed"}
+	}
+	return []string{
+		"hole punching works with cone peers, both sides must punch at the same time (see -rendezvous)",
+		"if the peer is symmetric it needs -predict=on, and -ttl=auto on our side helps keep our mapping clean",
+	}
+}
+
+func natcheckRequest(change byte) *stunMessage {
+	req := newStunRequest()
+	if change != 0 {
+		req.attrs = append(req.attrs, stunAttr{stunAttrChangeRequest, []byte{0, 0, 0, change}})
+	}
+	return req
+}
+
+// Run a binding transaction, returns the mapped address or nil.
+func natcheckQuery(conn net.PacketConn, saddr *net.UDPAddr, req *stunMessage, tries int) (*net.UDPAddr, *stunMessage) {
+	m, _, err := stunTransact(conn, saddr, req, tries)
+	if err != nil {
+		return nil, nil
+	}
+	ip, port, err := m.mapped(req)
+	if err != nil {
+		return nil, nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, m
+}
+
+// Whether a packet sent to our own public address comes back to us.
+func checkHairpin(conn net.PacketConn, mapped *net.UDPAddr) bool {
+	other, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false
+	}
+	defer other.Close()
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1024)
+	for i:=0; i<natcheckTries; i++ {
+		other.WriteTo(token, mapped)
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(buf[:n], token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find how long an idle mapping survives: each socket gets mapped, then
+// after its interval the server is asked (from another socket) to send a
+// response to that mapping with RESPONSE-ADDRESS.
+func checkLifetime(saddr *net.UDPAddr, max time.Duration) string {
+	probe := func(conn net.PacketConn, mapped *net.UDPAddr) bool {
+		sender, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return false
+		}
+		defer sender.Close()
+		req := newStunRequest()
+		req.attrs = append(req.attrs, stunAttr{stunAttrResponseAddr, stunAddr(mapped.IP, mapped.Port, nil)})
+		buf := make([]byte, 1024)
+		for i:=0; i<natcheckTries; i++ {
+			sender.WriteTo(req.marshal(), saddr)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				if m, err := parseStunMessage(buf[:n]); err == nil && bytes.Equal(m.txid, req.txid) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// the server must support RESPONSE-ADDRESS for this to mean anything
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return "unknown"
+	}
+	mapped, _ := natcheckQuery(conn, saddr, newStunRequest(), 4)
+	ok := mapped != nil && probe(conn, mapped)
+	conn.Close()
+	if !ok {
+		return "unknown (server does not support RESPONSE-ADDRESS)"
+	}
+
+	var intervals []time.Duration
+	for d:=natcheckLifetimeStart; d<=max; d*=2 {
+		intervals = append(intervals, d)
+	}
+	if len(intervals) == 0 {
+		return "not measured"
+	}
+	fmt.Printf("measuring mapping lifetime, this takes %v ...\n", intervals[len(intervals)-1])
+
+	alive := make([]bool, len(intervals))
+	var wg sync.WaitGroup
+	for i, d := range intervals {
+		wg.Add(1)
+		go func(i int, d time.Duration) {
+			defer wg.Done()
+			conn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			mapped, _ := natcheckQuery(conn, saddr, newStunRequest(), 4)
+			if mapped == nil {
+				return
+			}
+			time.Sleep(d)
+			alive[i] = probe(conn, mapped)
+			PrintDbgf("natcheck: mapping idle for %v alive=%v\n", d, alive[i])
+		}(i, d)
+	}
+	wg.Wait()
+
+	for i, ok := range alive {
+		if !ok {
+			if i == 0 {
+				return fmt.Sprintf("less than %v", intervals[0])
+			}
+			return fmt.Sprintf("between %v and %v", intervals[i-1], intervals[i])
+		}
+	}
+	return fmt.Sprintf("at least %v", intervals[len(intervals)-1])
+}
+
+// Classify our NAT like RFC 3489/5780: mapping behaviour from the mapped
+// addresses seen by two server addresses, filtering from responses sent
+// from an address we never talked to. @servers are STUN servers, ideally
+// gole stun-servers started with an alternate address.
+func NATCheck(servers []string, lifetime time.Duration) (*natReport, error) {
+	saddr, err := net.ResolveUDPAddr("udp", stunServerAddr(servers[0]))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	r := &natReport{local: conn.LocalAddr().(*net.UDPAddr)}
+
+	// test I: plain binding request
+	mapped, m := natcheckQuery(conn, saddr, newStunRequest(), 4)
+	if mapped == nil {
+		return nil, fmt.Errorf("%w, UDP may be blocked", errStunTimeout)
+	}
+	r.mapped = mapped
+	r.nat = mapped.Port != r.local.Port || !isLocalIP(mapped.IP)
+	fmt.Printf("local address: %s\n", r.local)
+	fmt.Printf("mapped address: %s\n", mapped)
+
+	var other *net.UDPAddr
+	if a := m.attr(stunAttrOtherAddr); a != nil {
+		if ip, port, err := parseStunAddr(a, nil); err == nil {
+			if ip.IsUnspecified() {
+				ip = saddr.IP
+			}
+			other = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+
+	// filtering, before we talk to any other server address
+	if other != nil {
+		full := false
+		if !other.IP.Equal(saddr.IP) {
+			a, _ := natcheckQuery(conn, saddr, natcheckRequest(stunChangeIP|stunChangePort), natcheckTries)
+			full = a != nil
+		}
+		if full {
+			r.filtering = "full"
+		} else if other.Port != saddr.Port {
+			a, _ := natcheckQuery(conn, saddr, natcheckRequest(stunChangePort), natcheckTries)
+			if a == nil {
+				r.filtering = "port-restricted"
+			} else if !other.IP.Equal(saddr.IP) {
+				r.filtering = "restricted"
+			} else {
+				r.filtering = "restricted or full" // no alternate IP to tell them apart
+			}
+		}
+	}
+
+	// mapping: same socket towards a second server address
+	var mapped2 *net.UDPAddr
+	var via string
+	if other != nil {
+		mapped2, _ = natcheckQuery(conn, other, newStunRequest(), 4)
+		via = other.String()
+	} else if len(servers) > 1 {
+		mapped2, _ = stunQueryUDP(conn, servers[1])
+		via = servers[1]
+	}
+	switch {
+	case mapped2 == nil:
+		r.mapping = "unknown, needs a second server or a stun-server with an alternate address"
+	case mapped2.String() != mapped.String():
+		r.symmetric = true
+		r.mapping = fmt.Sprintf("endpoint dependent (%s via %s)", mapped2, via)
+		r.pattern = probeNAT(&net.UDPAddr{}, servers[:1], nil)
+	default:
+		r.mapping = "endpoint independent"
+	}
+
+	if !r.nat {
+		return r, nil
+	}
+	r.hairpin = checkHairpin(conn, mapped)
+	r.lifetime = "not measured"
+	if lifetime > 0 {
+		r.lifetime = checkLifetime(saddr, lifetime)
+	}
+	return r, nil
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *natReport) Print() {
+	fmt.Println("====================")
+	fmt.Printf("nat type: %s\n", r.kind())
+	fmt.Printf("mapping: %s\n", r.mapping)
+	if r.symmetric {
+		fmt.Printf("port allocation: %s\n", r.pattern)
+	}
+	if r.nat {
+		filtering := r.filtering
+		if filtering == "" {
+			filtering = "unknown, needs a stun-server with an alternate address"
+		}
+		fmt.Printf("filtering: %s\n", filtering)
+		fmt.Printf("hairpinning: %v\n", r.hairpin)
+		fmt.Printf("mapping lifetime: %s\n", r.lifetime)
+	}
+	fmt.Println("recommendations:")
+	for _, rec := range r.recommend() {
+		fmt.Printf("  * %s\n", rec)
+	}
+}
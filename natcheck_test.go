@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stun server as seen through a pretend NAT in front of the client:
+// mapped ports are shifted by @shift, CHANGE-REQUESTs asking for more than
+// @allow are filtered, and RESPONSE-ADDRESS only reaches a mapping for
+// @lifetime after it was made (RESPONSE-ADDRESS unsupported if 0).
+type testNAT struct {
+	shift int
+	allow byte
+	other *net.UDPAddr
+	lifetime time.Duration
+
+	mu sync.Mutex
+	made map[int]time.Time // by mapped port
+}
+
+func testNATServer(t *testing.T, ip string, n *testNAT) *net.UDPAddr {
+	t.Helper()
+	n.made = make(map[int]time.Time)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			sz, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := parseStunMessage(buf[:sz])
+			if err != nil || req.change()&^n.allow != 0 {
+				continue
+			}
+			raddr := addr.(*net.UDPAddr)
+			port := raddr.Port + n.shift
+
+			n.mu.Lock()
+			if _, ok := n.made[port]; !ok {
+				n.made[port] = time.Now()
+			}
+			to := raddr
+			if a := req.attr(stunAttrResponseAddr); a != nil && n.lifetime > 0 {
+				ip, p, err := parseStunAddr(a, nil)
+				made, ok := n.made[p]
+				if err != nil || !ok || time.Since(made) > n.lifetime {
+					n.mu.Unlock()
+					continue // mapping expired, dropped by the NAT
+				}
+				to = &net.UDPAddr{IP: ip, Port: p - n.shift}
+			}
+			n.mu.Unlock()
+			conn.WriteTo(stunResponse(req, raddr.IP, port, n.other).marshal(), to)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestNATCheckNoNAT(t *testing.T) {
+	t.Parallel()
+	_, saddr := testStunServer(t, "127.0.0.2")
+	r, err := NATCheck([]string{saddr.String()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.nat || r.symmetric || r.mapping != "endpoint independent" || r.filtering != "full" {
+		t.Fatalf("nat=%v symmetric=%v mapping=%q filtering=%q", r.nat, r.symmetric, r.mapping, r.filtering)
+	}
+	if r.mapped.Port != r.local.Port {
+		t.Fatalf("mapped %s for local %s", r.mapped, r.local)
+	}
+	if r.kind() != "no NAT (public address)" {
+		t.Fatalf("kind() = %q", r.kind())
+	}
+}
+
+func TestNATCheckAltPortOnly(t *testing.T) {
+	t.Parallel()
+	_, saddr := testStunServer(t, "127.0.0.1")
+	r, err := NATCheck([]string{saddr.String()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.mapping != "endpoint independent" || r.filtering != "restricted or full" {
+		t.Fatalf("mapping=%q filtering=%q", r.mapping, r.filtering)
+	}
+}
+
+func TestNATCheckSingleServer(t *testing.T) {
+	t.Parallel()
+	_, saddr := testStunServer(t, "")
+	r, err := NATCheck([]string{saddr.String()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.filtering != "" || !strings.HasPrefix(r.mapping, "unknown") {
+		t.Fatalf("mapping=%q filtering=%q", r.mapping, r.filtering)
+	}
+
+	// a second server tells the mapping apart
+	_, saddr2 := testStunServer(t, "")
+	r, err = NATCheck([]string{saddr.String(), saddr2.String()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.mapping != "endpoint independent" {
+		t.Fatalf("mapping=%q", r.mapping)
+	}
+}
+
+func TestNATCheckSymmetric(t *testing.T) {
+	t.Parallel()
+	s1 := testNATServer(t, "127.0.0.1", &testNAT{shift: 1000})
+	s2 := testNATServer(t, "127.0.0.1", &testNAT{shift: 2000})
+	r, err := NATCheck([]string{s1.String(), s2.String()}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.nat || !r.symmetric || !strings.HasPrefix(r.mapping, "endpoint dependent") {
+		t.Fatalf("nat=%v symmetric=%v mapping=%q", r.nat, r.symmetric, r.mapping)
+	}
+	if r.mapped.Port != r.local.Port+1000 {
+		t.Fatalf("mapped %s for local %s", r.mapped, r.local)
+	}
+	if r.kind() != "symmetric" || !strings.Contains(strings.Join(r.recommend(), "\n"), "-predict") {
+		t.Fatalf("kind() = %q, recommend() = %q", r.kind(), r.recommend())
+	}
+	if r.hairpin || r.lifetime != "not measured" {
+		t.Fatalf("hairpin=%v lifetime=%q", r.hairpin, r.lifetime)
+	}
+}
+
+func TestNATCheckFiltering(t *testing.T) {
+	t.Parallel()
+	for _, c := range []struct {
+		allow byte
+		altIP string
+		filtering string
+	}{
+		{stunChangeIP|stunChangePort, "127.0.0.2", "full"},
+		{stunChangePort, "127.0.0.2", "restricted"},
+		{0, "127.0.0.1", "port-restricted"},
+	} {
+		// the alternate address answers plain requests with the same mapping
+		other := testNATServer(t, c.altIP, &testNAT{shift: 1000})
+		saddr := testNATServer(t, "127.0.0.1", &testNAT{shift: 1000, allow: c.allow, other: other})
+		r, err := NATCheck([]string{saddr.String()}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.filtering != c.filtering || !r.nat {
+			t.Fatalf("allow %#x: nat=%v filtering=%q, want %q", c.allow, r.nat, r.filtering, c.filtering)
+		}
+		if r.kind() != c.filtering+" cone" {
+			t.Fatalf("allow %#x: kind() = %q", c.allow, r.kind())
+		}
+	}
+}
+
+func TestCheckHairpin(t *testing.T) {
+	t.Parallel()
+	conn := testUDPConn(t)
+	if !checkHairpin(conn, conn.LocalAddr().(*net.UDPAddr)) {
+		t.Fatal("no hairpin to our own address")
+	}
+	closed := testUDPConn(t)
+	addr := closed.LocalAddr().(*net.UDPAddr)
+	closed.Close()
+	if checkHairpin(conn, addr) {
+		t.Fatal("hairpin through another address")
+	}
+}
+
+func TestCheckLifetime(t *testing.T) {
+	t.Parallel()
+	_, saddr := testStunServer(t, "")
+	if got := checkLifetime(saddr, natcheckLifetimeStart); got != "at least 5s" {
+		t.Fatalf("checkLifetime() = %q", got)
+	}
+}
+
+func TestCheckLifetimeExpired(t *testing.T) {
+	t.Parallel()
+	saddr := testNATServer(t, "127.0.0.1", &testNAT{lifetime: 2 * time.Second})
+	if got := checkLifetime(saddr, natcheckLifetimeStart); got != "less than 5s" {
+		t.Fatalf("checkLifetime() = %q", got)
+	}
+}
+
+func TestCheckLifetimeUnsupported(t *testing.T) {
+	t.Parallel()
+	saddr := testNATServer(t, "127.0.0.1", &testNAT{})
+	if got := checkLifetime(saddr, natcheckLifetimeStart); !strings.HasPrefix(got, "unknown") {
+		t.Fatalf("checkLifetime() = %q", got)
+	}
+}
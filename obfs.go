@@ -0,0 +1,325 @@
+package main
+//
+// Traffic obfuscation: random padding, write splitting/merging and
+// timing jitter on top of EConn and EPacketConn
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	obfsMinChunk = 512 // stream writes are split into chunks of random size
+	obfsMaxChunk = 8192
+	obfsMergeSize = 1400 // merged writes are flushed once this big
+	obfsPacketMax = 1400 // padding never grows a datagram beyond this
+)
+
+var errObfsFrame = errors.New("obfs: malformed frame")
+
+type ObfsConfig struct {
+	MaxPad int // max padding bytes per frame or datagram
+	Jitter time.Duration // max random delay before each send
+	Merge time.Duration // hold small writes up to this long to merge them
+}
+
+func (oc *ObfsConfig) padding(room int) []byte {
+	max := oc.MaxPad
+	if room < max {
+		max = room
+	}
+	if max <= 0 {
+		return nil
+	}
+	pad := make([]byte, rand.Intn(max+1))
+	rand.Read(pad)
+	return pad
+}
+
+func (oc *ObfsConfig) jitter() {
+	if oc.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(oc.Jitter))))
+	}
+}
+
+// Stream frames:
+//
+//   [2-byte data length][2-byte padding length][data][padding]
+//
+type ObfsConn struct {
+	conn net.Conn
+	conf *ObfsConfig
+	rbuf []byte
+	wmu sync.Mutex
+	pending []byte // merged writes not yet sent
+	timer *time.Timer
+	werr error // error from a delayed flush
+}
+func (oconn *ObfsConn) Conn() net.Conn {
+	return oconn.conn
+}
+func (oconn *ObfsConn) Read(b []byte) (n int, err error) {
+	hdr := make([]byte, 4)
+	for len(oconn.rbuf) == 0 {
+		if _, err = io.ReadFull(oconn.conn, hdr); err != nil {
+			return 0, err
+		}
+		dlen := int(binary.BigEndian.Uint16(hdr))
+		plen := int(binary.BigEndian.Uint16(hdr[2:]))
+		frame := make([]byte, dlen+plen)
+		if _, err = io.ReadFull(oconn.conn, frame); err != nil {
+			return 0, err
+		}
+		oconn.rbuf = frame[:dlen]
+	}
+	n = copy(b, oconn.rbuf)
+	oconn.rbuf = oconn.rbuf[n:]
+	return n, nil
+}
+// split @b into randomly sized, padded frames
+func (oconn *ObfsConn) writeFrames(b []byte) error {
+	for len(b) > 0 {
+		n := obfsMinChunk + rand.Intn(obfsMaxChunk-obfsMinChunk)
+		if n > len(b) {
+			n = len(b)
+		}
+		pad := oconn.conf.padding(oconn.conf.MaxPad)
+		frame := make([]byte, 4, 4+n+len(pad))
+		binary.BigEndian.PutUint16(frame, uint16(n))
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(pad)))
+		frame = append(append(frame, b[:n]...), pad...)
+
+		oconn.conf.jitter()
+		if _, err := oconn.conn.Write(frame); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+// caller must hold oconn.wmu
+func (oconn *ObfsConn) flush() {
+	if oconn.timer != nil {
+		oconn.timer.Stop()
+		oconn.timer = nil
+	}
+	if len(oconn.pending) > 0 && oconn.werr == nil {
+		oconn.werr = oconn.writeFrames(oconn.pending)
+	}
+	oconn.pending = nil
+}
+func (oconn *ObfsConn) Write(b []byte) (n int, err error) {
+	oconn.wmu.Lock()
+	defer oconn.wmu.Unlock()
+	if oconn.werr != nil {
+		return 0, oconn.werr
+	}
+	if oconn.conf.Merge <= 0 {
+		if err = oconn.writeFrames(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	oconn.pending = append(oconn.pending, b...)
+	if len(oconn.pending) >= obfsMergeSize {
+		oconn.flush()
+	} else if oconn.timer == nil {
+		oconn.timer = time.AfterFunc(oconn.conf.Merge, func() {
+			oconn.wmu.Lock()
+			oconn.flush()
+			oconn.wmu.Unlock()
+		})
+	}
+	return len(b), oconn.werr
+}
+// send merged writes now, before the socket underneath changes hands
+func (oconn *ObfsConn) Flush() error {
+	oconn.wmu.Lock()
+	defer oconn.wmu.Unlock()
+	oconn.flush()
+	return oconn.werr
+}
+func (oconn *ObfsConn) Close() error {
+	oconn.wmu.Lock()
+	oconn.flush()
+	oconn.wmu.Unlock()
+	return oconn.conn.Close()
+}
+func (oconn *ObfsConn) LocalAddr() net.Addr {
+	return oconn.conn.LocalAddr()
+}
+func (oconn *ObfsConn) RemoteAddr() net.Addr {
+	return oconn.conn.RemoteAddr()
+}
+func (oconn *ObfsConn) SetDeadline(t time.Time) error {
+	return oconn.conn.SetDeadline(t)
+}
+func (oconn *ObfsConn) SetReadDeadline(t time.Time) error {
+	return oconn.conn.SetReadDeadline(t)
+}
+func (oconn *ObfsConn) SetWriteDeadline(t time.Time) error {
+	return oconn.conn.SetWriteDeadline(t)
+}
+
+// Datagrams:
+//
+//   [2-byte padding length][payload][padding]
+//
+type ObfsPacketConn struct {
+	conn net.PacketConn
+	conf *ObfsConfig
+	rbuf []byte
+	rmu sync.Mutex
+}
+func (oconn *ObfsPacketConn) Conn() net.Conn {
+	if nc, ok := oconn.conn.(net.Conn); ok {
+		return nc
+	}
+	return nil
+}
+func (oconn *ObfsPacketConn) pad(b []byte) []byte {
+	pad := oconn.conf.padding(obfsPacketMax-2-len(b))
+	out := make([]byte, 2, 2+len(b)+len(pad))
+	binary.BigEndian.PutUint16(out, uint16(len(pad)))
+	return append(append(out, b...), pad...)
+}
+func unpad(p []byte) ([]byte, error) {
+	if len(p) < 2 {
+		return nil, errObfsFrame
+	}
+	plen := int(binary.BigEndian.Uint16(p))
+	if 2+plen > len(p) {
+		return nil, errObfsFrame
+	}
+	return p[2:len(p)-plen], nil
+}
+// Verify, decrypt and unpad datagram @p into @b.
+func (oconn *ObfsPacketConn) Open(b, p []byte) (int, error) {
+	if opener, ok := oconn.conn.(packetOpener); ok {
+		n, err := opener.Open(p, p)
+		if err != nil {
+			return 0, err
+		}
+		p = p[:n]
+	}
+	data, err := unpad(p)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, data), nil
+}
+func (oconn *ObfsPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	oconn.rmu.Lock()
+	defer oconn.rmu.Unlock()
+	for {
+		n, addr, err = oconn.conn.ReadFrom(oconn.rbuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		data, err := unpad(oconn.rbuf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, data), addr, nil
+	}
+}
+func (oconn *ObfsPacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	oconn.conf.jitter()
+	if _, err = oconn.conn.WriteTo(oconn.pad(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+func (oconn *ObfsPacketConn) Close() error {
+	return oconn.conn.Close()
+}
+func (oconn *ObfsPacketConn) LocalAddr() net.Addr {
+	return oconn.conn.LocalAddr()
+}
+func (oconn *ObfsPacketConn) SetDeadline(t time.Time) error {
+	return oconn.conn.SetDeadline(t)
+}
+func (oconn *ObfsPacketConn) SetReadDeadline(t time.Time) error {
+	return oconn.conn.SetReadDeadline(t)
+}
+func (oconn *ObfsPacketConn) SetWriteDeadline(t time.Time) error {
+	return oconn.conn.SetWriteDeadline(t)
+}
+func (oconn *ObfsPacketConn) SetReadBuffer(bytes int) error {
+	if nc, ok := oconn.conn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("not implemented")
+}
+func (oconn *ObfsPacketConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := oconn.conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("not implemented")
+}
+func (oconn *ObfsPacketConn) SyscallConn() (syscall.RawConn, error) {
+	if nc, ok := oconn.conn.(syscall.Conn); ok {
+		return nc.SyscallConn()
+	}
+	return nil, errors.New("not implemented")
+}
+
+// for compatibility with net.Conn
+func (oconn *ObfsPacketConn) Read(b []byte) (n int, err error) {
+	conn, ok := oconn.conn.(net.Conn)
+	if ok {
+		oconn.rmu.Lock()
+		defer oconn.rmu.Unlock()
+		for {
+			n, err = conn.Read(oconn.rbuf)
+			if err != nil {
+				return 0, err
+			}
+			data, err := unpad(oconn.rbuf[:n])
+			if err != nil {
+				continue
+			}
+			return copy(b, data), nil
+		}
+	}
+	return 0, errors.New("not implemented")
+}
+func (oconn *ObfsPacketConn) Write(b []byte) (n int, err error) {
+	conn, ok := oconn.conn.(net.Conn)
+	if ok {
+		oconn.conf.jitter()
+		if _, err = conn.Write(oconn.pad(b)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return 0, errors.New("not implemented")
+}
+func (oconn *ObfsPacketConn) RemoteAddr() net.Addr {
+	if conn, ok := oconn.conn.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func NewObfsConn(conn net.Conn, oc *ObfsConfig) net.Conn {
+	if oc == nil {
+		return conn
+	}
+	return &ObfsConn{conn: conn, conf: oc}
+}
+
+func NewObfsPacketConn(conn net.PacketConn, oc *ObfsConfig) net.PacketConn {
+	if oc == nil {
+		return conn
+	}
+	return &ObfsPacketConn{conn: conn, conf: oc, rbuf: make([]byte, 65536)}
+}
@@ -0,0 +1,528 @@
+package main
+//
+// Port mapping on the local router with NAT-PMP, PCP or UPnP-IGD
+//
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	portmapLifetime = 3600 * time.Second // renewed at half-life
+	pcpVersion = 2
+)
+
+// where gateways listen, tests point these at local responders
+var (
+	natpmpPort = 5351
+	ssdpAddr = "239.255.255.250:1900"
+)
+
+var errPortmapTimeout = errors.New("portmap: no response from gateway")
+
+type PortMapConfig struct {
+	Method string // auto|upnp|natpmp|pcp
+	Gateway net.IP // router to ask, guessed if nil
+}
+
+// Params:
+//   auto|upnp|natpmp|pcp|off[,gateway=IP]
+func parsePortMap(s string) *PortMapConfig {
+	params := strings.Split(s, ",")
+	if params[0] == "off" || params[0] == "" {
+		return nil
+	}
+	if !contains(params[0], []string{"auto", "upnp", "natpmp", "pcp"}) {
+		perror("Unknown port mapping method:", params[0])
+		os.Exit(1)
+	}
+	pc := &PortMapConfig{Method: params[0]}
+	for _, v := range params[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 && kv[0] == "gateway" {
+			if pc.Gateway = net.ParseIP(kv[1]); pc.Gateway == nil {
+				perror("Invalid gateway:", kv[1])
+				os.Exit(1)
+			}
+		} else {
+			perror("Unknown port mapping parameters:", v)
+			os.Exit(1)
+		}
+	}
+	return pc
+}
+
+// A way to ask the router for an inbound mapping.
+type portMapper interface {
+	name() string
+	// map external port to our @port, returns the external address
+	add(proto string, port int, lifetime time.Duration) (net.IP, int, error)
+	remove(proto string, port int) error
+}
+
+// Default IPv4 gateway from the routing table, or x.x.x.1 of our address.
+func defaultGateway() net.IP {
+	if data, err := ioutil.ReadFile("/proc/net/route"); err == nil {
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fs := strings.Fields(line)
+			if len(fs) < 3 || fs[1] != "00000000" {
+				continue
+			}
+			gw, err := hex.DecodeString(fs[2])
+			if err != nil || len(gw) != 4 {
+				continue
+			}
+			return net.IPv4(gw[3], gw[2], gw[1], gw[0])
+		}
+	}
+	if ip := localIP(nil); ip != nil {
+		return net.IPv4(ip[0], ip[1], ip[2], 1)
+	}
+	return nil
+}
+
+// Our address on the interface towards @gw, or the default route if nil.
+func localIP(gw net.IP) net.IP {
+	to := "192.0.2.1:9" // TEST-NET, nothing is sent
+	if gw != nil {
+		to = net.JoinHostPort(gw.String(), "9")
+	}
+	conn, err := net.Dial("udp4", to)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4()
+}
+
+// Send @req to @addr and return the first response @accept likes,
+// retransmitting with a doubling timeout like NAT-PMP/PCP do.
+func gatewayRequest(addr *net.UDPAddr, req []byte, accept func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	rto := 250 * time.Millisecond
+	for i:=0; i<4; i++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(rto))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if accept(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		rto *= 2
+	}
+	return nil, errPortmapTimeout
+}
+
+// NAT-PMP (RFC 6886)
+type natpmpMapper struct {
+	gw *net.UDPAddr
+}
+func (m *natpmpMapper) name() string {
+	return "natpmp"
+}
+func natpmpOp(proto string) byte {
+	if proto == "tcp" {
+		return 2
+	}
+	return 1
+}
+func natpmpResult(code uint16) error {
+	if code != 0 {
+		return fmt.Errorf("natpmp: gateway refused with result code %d", code)
+	}
+	return nil
+}
+func (m *natpmpMapper) externalIP() (net.IP, error) {
+	resp, err := gatewayRequest(m.gw, []byte{0, 0}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == 0 && b[1] == 128
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = natpmpResult(binary.BigEndian.Uint16(resp[2:])); err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+func (m *natpmpMapper) request(proto string, port, ext int, lifetime time.Duration) (int, error) {
+	op := natpmpOp(proto)
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(port))
+	binary.BigEndian.PutUint16(req[6:], uint16(ext))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := gatewayRequest(m.gw, req, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == 0 && b[1] == 128+op && int(binary.BigEndian.Uint16(b[8:])) == port
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = natpmpResult(binary.BigEndian.Uint16(resp[2:])); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:])), nil
+}
+func (m *natpmpMapper) add(proto string, port int, lifetime time.Duration) (net.IP, int, error) {
+	ext, err := m.request(proto, port, port, lifetime)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, ext, nil
+}
+func (m *natpmpMapper) remove(proto string, port int) error {
+	_, err := m.request(proto, port, 0, 0)
+	return err
+}
+
+// PCP (RFC 6887), MAP opcode only
+type pcpMapper struct {
+	gw *net.UDPAddr
+	client net.IP
+	nonce []byte // identifies our mappings across renewals
+}
+func (m *pcpMapper) name() string {
+	return "pcp"
+}
+func (m *pcpMapper) request(proto string, port int, lifetime time.Duration) (net.IP, int, error) {
+	pnum := byte(17)
+	if proto == "tcp" {
+		pnum = 6
+	}
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = 1 // MAP
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], m.client.To16())
+	copy(req[24:36], m.nonce)
+	req[36] = pnum
+	binary.BigEndian.PutUint16(req[40:], uint16(port))
+	binary.BigEndian.PutUint16(req[42:], uint16(port))
+	copy(req[44:60], net.IPv4zero.To16())
+	resp, err := gatewayRequest(m.gw, req, func(b []byte) bool {
+		return len(b) >= 60 && b[0] == pcpVersion && b[1] == 0x81 && bytes.Equal(b[24:36], m.nonce)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp[3] != 0 {
+		return nil, 0, fmt.Errorf("pcp: gateway refused with result code %d", resp[3])
+	}
+	return net.IP(append([]byte(nil), resp[44:60]...)), int(binary.BigEndian.Uint16(resp[42:])), nil
+}
+func (m *pcpMapper) add(proto string, port int, lifetime time.Duration) (net.IP, int, error) {
+	return m.request(proto, port, lifetime)
+}
+func (m *pcpMapper) remove(proto string, port int) error {
+	_, _, err := m.request(proto, port, 0)
+	return err
+}
+
+// UPnP Internet Gateway Device, found with SSDP and driven with SOAP
+type upnpMapper struct {
+	control string // control URL of the WAN connection service
+	service string // its service type
+	client net.IP
+}
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL string `xml:"controlURL"`
+}
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+func (d *upnpDevice) wanService() *upnpService {
+	for i, s := range d.Services {
+		if strings.Contains(s.ServiceType, "WANIPConnection") || strings.Contains(s.ServiceType, "WANPPPConnection") {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].wanService(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// Find the gateway's WAN connection service.
+func discoverUPnP() (*upnpMapper, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	to, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+
+	buf := make([]byte, 2048)
+	for i:=0; i<2; i++ {
+		if _, err = conn.WriteTo([]byte(search), to); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			if err != nil {
+				continue
+			}
+			loc := resp.Header.Get("Location")
+			if loc == "" {
+				continue
+			}
+			PrintDbgf("portmap: upnp device at %s (%s)\n", loc, from)
+			m, err := upnpDescribe(loc)
+			if err != nil {
+				PrintDbgf("portmap: %v\n", err)
+				continue
+			}
+			return m, nil
+		}
+	}
+	return nil, errors.New("upnp: no internet gateway device found")
+}
+
+func upnpDescribe(location string) (*upnpMapper, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string `xml:"URLBase"`
+		Device upnpDevice `xml:"device"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	s := root.Device.wanService()
+	if s == nil {
+		return nil, errors.New("upnp: no WAN connection service at " + location)
+	}
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	bu, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	cu, err := bu.Parse(s.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(cu.Host)
+	return &upnpMapper{control: cu.String(), service: s.ServiceType, client: localIP(net.ParseIP(host))}, nil
+}
+
+// Invoke @action with @args (name, value pairs), returns the response body.
+func (m *upnpMapper) soap(action string, args ...string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + m.service + `">`)
+	for i:=0; i+1<len(args); i+=2 {
+		body.WriteString("<" + args[i] + ">")
+		xml.EscapeText(&body, []byte(args[i+1]))
+		body.WriteString("</" + args[i] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", m.control, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+m.service+"#"+action+`"`)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		code := xmlValue(data, "errorCode")
+		return nil, fmt.Errorf("upnp: %s failed: %s %s", action, code, xmlValue(data, "errorDescription"))
+	}
+	return data, nil
+}
+
+// text of the first element named @name in @data
+func xmlValue(data []byte, name string) string {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == name {
+			var v string
+			dec.DecodeElement(&v, &se)
+			return v
+		}
+	}
+}
+
+func (m *upnpMapper) name() string {
+	return "upnp"
+}
+func (m *upnpMapper) add(proto string, port int, lifetime time.Duration) (net.IP, int, error) {
+	if m.client == nil {
+		return nil, 0, errors.New("upnp: can't tell our LAN address")
+	}
+	args := []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(port),
+		"NewProtocol", strings.ToUpper(proto),
+		"NewInternalPort", strconv.Itoa(port),
+		"NewInternalClient", m.client.String(),
+		"NewEnabled", "1",
+		"NewPortMappingDescription", "gole",
+		"NewLeaseDuration", strconv.Itoa(int(lifetime/time.Second)),
+	}
+	_, err := m.soap("AddPortMapping", args...)
+	if err != nil && strings.Contains(err.Error(), " 725 ") {
+		// OnlyPermanentLeasesSupported
+		args[len(args)-1] = "0"
+		_, err = m.soap("AddPortMapping", args...)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := m.soap("GetExternalIPAddress")
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(xmlValue(data, "NewExternalIPAddress"))
+	if ip == nil {
+		return nil, 0, errors.New("upnp: gateway has no external address")
+	}
+	return ip, port, nil
+}
+func (m *upnpMapper) remove(proto string, port int) error {
+	_, err := m.soap("DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(port),
+		"NewProtocol", strings.ToUpper(proto))
+	return err
+}
+
+func newPortMapper(method string, gw net.IP) (portMapper, error) {
+	gaddr := &net.UDPAddr{IP: gw, Port: natpmpPort}
+	switch method {
+	case "natpmp":
+		return &natpmpMapper{gw: gaddr}, nil
+	case "pcp":
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		return &pcpMapper{gw: gaddr, client: localIP(gw), nonce: nonce}, nil
+	case "upnp":
+		return discoverUPnP()
+	}
+	return nil, errors.New("unknown port mapping method " + method)
+}
+
+// Ask the router to forward @proto @port to us, keep the mapping alive in
+// the background and remove it on exit. Failing is not fatal, punching
+// goes ahead anyway. Returns the external address, nil if not mapped.
+func startPortMap(pc *PortMapConfig, proto string, port int) (net.IP, int) {
+	if port == 0 {
+		perror("portmap: local_addr needs a fixed port to be mapped")
+		return nil, 0
+	}
+	gw := pc.Gateway
+	if gw == nil {
+		if gw = defaultGateway(); gw == nil {
+			perror("portmap: no default gateway found, set one with -portmap=METHOD,gateway=IP")
+			return nil, 0
+		}
+	}
+	methods := []string{pc.Method}
+	if pc.Method == "auto" {
+		methods = []string{"pcp", "natpmp", "upnp"}
+	}
+
+	for _, method := range methods {
+		m, err := newPortMapper(method, gw)
+		if err != nil {
+			PrintDbgf("portmap: %s: %v\n", method, err)
+			continue
+		}
+		ip, ext, err := m.add(proto, port, portmapLifetime)
+		if err != nil {
+			perror(fmt.Sprintf("portmap: %s failed.", method), err)
+			continue
+		}
+		fmt.Printf("portmap: %s mapped %s:%d -> local port %d (%s via %s)\n", proto, ip, ext, port, m.name(), gw)
+		fmt.Printf("portmap: peer should use %s as remote address\n", net.JoinHostPort(ip.String(), strconv.Itoa(ext)))
+
+		done := make(chan struct{})
+		atExit(func() {
+			close(done)
+			if err := m.remove(proto, port); err != nil {
+				perror("portmap: failed to remove mapping.", err)
+			} else {
+				fmt.Printf("portmap: removed %s mapping for port %d\n", proto, port)
+			}
+		})
+		go func() {
+			for {
+				select {
+				case <-time.After(portmapLifetime / 2):
+				case <-done:
+					return
+				}
+				if _, _, err := m.add(proto, port, portmapLifetime); err != nil {
+					perror("portmap: renew failed.", err)
+				}
+			}
+		}()
+		return ip, ext
+	}
+	perror("portmap: no port mapping method worked, punching without one")
+	return nil, 0
+}
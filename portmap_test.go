@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testExternalIP = net.IPv4(203, 0, 113, 5)
+
+// Requests seen by a pretend gateway.
+type testGateway struct {
+	mu sync.Mutex
+	reqs [][]byte
+}
+
+func (g *testGateway) record(b []byte) {
+	g.mu.Lock()
+	g.reqs = append(g.reqs, append([]byte(nil), b...))
+	g.mu.Unlock()
+}
+
+func (g *testGateway) requests() [][]byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([][]byte(nil), g.reqs...)
+}
+
+// Run the exit hooks added after the first @n and drop them, the way
+// exit() would without ending the test binary.
+func testRunExitHooks(n int) {
+	exitMu.Lock()
+	hooks := exitHooks[n:]
+	exitHooks = exitHooks[:n]
+	exitMu.Unlock()
+	for i:=len(hooks)-1; i>=0; i-- {
+		hooks[i]()
+	}
+}
+
+func testExitHookCount() int {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	return len(exitHooks)
+}
+
+// Point natpmpPort at @addr for the rest of the test.
+func testGatewayPort(t *testing.T, addr *net.UDPAddr) {
+	port := natpmpPort
+	natpmpPort = addr.Port
+	t.Cleanup(func() { natpmpPort = port })
+}
+
+// NAT-PMP gateway handing out external port @port+1000.
+func testNATPMPGateway(t *testing.T, g *testGateway) *net.UDPAddr {
+	return testResponder(t, func(req []byte) [][]byte {
+		g.record(req)
+		if len(req) == 2 && req[1] == 0 {
+			resp := make([]byte, 12)
+			resp[1] = 128
+			copy(resp[8:], testExternalIP.To4())
+			return [][]byte{resp}
+		}
+		if len(req) != 12 {
+			return nil
+		}
+		resp := make([]byte, 16)
+		resp[1] = 128 + req[1]
+		copy(resp[8:10], req[4:6])
+		if ext := binary.BigEndian.Uint16(req[6:]); ext != 0 {
+			binary.BigEndian.PutUint16(resp[10:], ext+1000)
+		}
+		copy(resp[12:], req[8:12])
+		return [][]byte{resp}
+	})
+}
+
+// PCP gateway handing out external port @port+1000.
+func testPCPGateway(t *testing.T, g *testGateway) *net.UDPAddr {
+	return testResponder(t, func(req []byte) [][]byte {
+		g.record(req)
+		if len(req) != 60 || req[0] != pcpVersion || req[1] != 1 {
+			return nil
+		}
+		resp := make([]byte, 60)
+		resp[0] = pcpVersion
+		resp[1] = 0x81
+		copy(resp[4:8], req[4:8])
+		copy(resp[24:], req[24:])
+		binary.BigEndian.PutUint16(resp[42:], binary.BigEndian.Uint16(req[40:])+1000)
+		copy(resp[44:], testExternalIP.To16())
+		return [][]byte{resp}
+	})
+}
+
+func TestNATPMP(t *testing.T) {
+	g := &testGateway{}
+	testGatewayPort(t, testNATPMPGateway(t, g))
+	n := testExitHookCount()
+
+	ip, port := startPortMap(&PortMapConfig{Method: "natpmp", Gateway: net.IPv4(127, 0, 0, 1)}, "udp", 40000)
+	if !ip.Equal(testExternalIP) || port != 41000 {
+		t.Fatalf("startPortMap() = %s:%d", ip, port)
+	}
+	reqs := g.requests()
+	want := []byte{0, 1, 0, 0, 0x9c, 0x40, 0x9c, 0x40, 0, 0, 0x0e, 0x10}
+	if len(reqs) != 2 || !bytes.Equal(reqs[0], want) || !bytes.Equal(reqs[1], []byte{0, 0}) {
+		t.Fatalf("requests %x, want %x and 0000", reqs, want)
+	}
+
+	testRunExitHooks(n)
+	reqs = g.requests()
+	want = []byte{0, 1, 0, 0, 0x9c, 0x40, 0, 0, 0, 0, 0, 0}
+	if len(reqs) != 3 || !bytes.Equal(reqs[2], want) {
+		t.Fatalf("removal requests %x, want %x", reqs[2:], want)
+	}
+
+	// tcp mappings use opcode 2
+	m := &natpmpMapper{gw: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: natpmpPort}}
+	if _, port, err := m.add("tcp", 40001, time.Minute); err != nil || port != 41001 {
+		t.Fatalf("add(tcp) = %d, %v", port, err)
+	}
+	if reqs = g.requests(); reqs[3][1] != 2 {
+		t.Fatalf("tcp request %x", reqs[3])
+	}
+}
+
+func TestNATPMPRefused(t *testing.T) {
+	gw := testResponder(t, func(req []byte) [][]byte {
+		resp := make([]byte, 16)
+		resp[1] = 128 + req[1]
+		resp[3] = 2 // not authorized
+		copy(resp[8:10], req[4:6])
+		return [][]byte{resp}
+	})
+	m := &natpmpMapper{gw: gw}
+	if _, _, err := m.add("udp", 40000, time.Minute); err == nil || !strings.Contains(err.Error(), "result code 2") {
+		t.Fatalf("add() = %v", err)
+	}
+}
+
+func TestPCP(t *testing.T) {
+	g := &testGateway{}
+	testGatewayPort(t, testPCPGateway(t, g))
+	n := testExitHookCount()
+
+	ip, port := startPortMap(&PortMapConfig{Method: "pcp", Gateway: net.IPv4(127, 0, 0, 1)}, "tcp", 40000)
+	if !ip.Equal(testExternalIP) || port != 41000 {
+		t.Fatalf("startPortMap() = %s:%d", ip, port)
+	}
+	reqs := g.requests()
+	if len(reqs) != 1 || len(reqs[0]) != 60 {
+		t.Fatalf("requests %x", reqs)
+	}
+	req := reqs[0]
+	if req[0] != pcpVersion || req[1] != 1 || binary.BigEndian.Uint32(req[4:]) != 3600 {
+		t.Fatalf("header %x", req[:8])
+	}
+	if !net.IP(req[8:24]).Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("client address %s", net.IP(req[8:24]))
+	}
+	if req[36] != 6 || binary.BigEndian.Uint16(req[40:]) != 40000 || binary.BigEndian.Uint16(req[42:]) != 40000 {
+		t.Fatalf("MAP opcode data %x", req[24:60])
+	}
+
+	testRunExitHooks(n)
+	reqs = g.requests()
+	if len(reqs) != 2 || binary.BigEndian.Uint32(reqs[1][4:]) != 0 {
+		t.Fatalf("removal requests %x", reqs[1:])
+	}
+	if !bytes.Equal(reqs[1][24:36], req[24:36]) {
+		t.Fatal("removal with another nonce")
+	}
+}
+
+func TestPCPNonceMismatch(t *testing.T) {
+	// answers meant for another client's mappings are ignored
+	gw := testResponder(t, func(req []byte) [][]byte {
+		resp := make([]byte, 60)
+		resp[0] = pcpVersion
+		resp[1] = 0x81
+		copy(resp[24:], req[24:])
+		resp[24] ^= 1
+		return [][]byte{resp}
+	})
+	m := &pcpMapper{gw: gw, client: net.IPv4(127, 0, 0, 1), nonce: make([]byte, 12)}
+	if _, _, err := m.add("udp", 40000, time.Minute); err != errPortmapTimeout {
+		t.Fatalf("add() = %v, want %v", err, errPortmapTimeout)
+	}
+}
+
+// UPnP IGD with its WAN connection service in a nested device, refusing
+// leases that aren't permanent.
+type testIGD struct {
+	mu sync.Mutex
+	mappings map[string]string // "UDP 40000" -> internal client
+	actions []string
+}
+
+func (d *testIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const service = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	if r.URL.Path == "/desc.xml" {
+		fmt.Fprint(w, `<?xml version="1.0"?><root><device><deviceList><device><serviceList>`+
+			`<service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/l3f</controlURL></service>`+
+			`<service><serviceType>`+service+`</serviceType><controlURL>ctl/ip</controlURL></service>`+
+			`</serviceList></device></deviceList></device></root>`)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	action := strings.TrimPrefix(strings.Trim(r.Header.Get("SOAPAction"), `"`), service+"#")
+	if r.URL.Path != "/ctl/ip" || !bytes.Contains(body, []byte("<u:"+action+` xmlns:u="`+service+`">`)) {
+		http.Error(w, "bad request", 400)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.actions = append(d.actions, action)
+	key := xmlValue(body, "NewProtocol") + " " + xmlValue(body, "NewExternalPort")
+	fault := func(code int, desc string) {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, desc)
+	}
+	switch action {
+	case "AddPortMapping":
+		if xmlValue(body, "NewLeaseDuration") != "0" {
+			fault(725, "OnlyPermanentLeasesSupported")
+			return
+		}
+		d.mappings[key] = xmlValue(body, "NewInternalClient") + ":" + xmlValue(body, "NewInternalPort")
+	case "DeletePortMapping":
+		if _, ok := d.mappings[key]; !ok {
+			fault(714, "NoSuchEntryInArray")
+			return
+		}
+		delete(d.mappings, key)
+	case "GetExternalIPAddress":
+		fmt.Fprintf(w, `<s:Envelope><s:Body><u:GetExternalIPAddressResponse><NewExternalIPAddress>%s</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, testExternalIP)
+		return
+	}
+	fmt.Fprint(w, `<s:Envelope><s:Body/></s:Envelope>`)
+}
+
+func TestUPnP(t *testing.T) {
+	igd := &testIGD{mappings: make(map[string]string)}
+	srv := httptest.NewServer(igd)
+	t.Cleanup(srv.Close)
+
+	var search []byte
+	var mu sync.Mutex
+	ssdp := testResponder(t, func(req []byte) [][]byte {
+		mu.Lock()
+		search = append([]byte(nil), req...)
+		mu.Unlock()
+		return [][]byte{
+			[]byte("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n"), // no location, skipped
+			[]byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nLOCATION: " + srv.URL + "/desc.xml\r\n\r\n"),
+		}
+	})
+	addr := ssdpAddr
+	ssdpAddr = ssdp.String()
+	t.Cleanup(func() { ssdpAddr = addr })
+	n := testExitHookCount()
+
+	ip, port := startPortMap(&PortMapConfig{Method: "upnp", Gateway: net.IPv4(127, 0, 0, 1)}, "udp", 40000)
+	if !ip.Equal(testExternalIP) || port != 40000 {
+		t.Fatalf("startPortMap() = %s:%d", ip, port)
+	}
+	mu.Lock()
+	s := string(search)
+	mu.Unlock()
+	if !strings.HasPrefix(s, "M-SEARCH * HTTP/1.1\r\n") || !strings.Contains(s, "\r\nMAN: \"ssdp:discover\"\r\n") ||
+		!strings.Contains(s, "\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n") {
+		t.Fatalf("search request %q", s)
+	}
+
+	igd.mu.Lock()
+	actions := strings.Join(igd.actions, ",")
+	mapped := igd.mappings["UDP 40000"]
+	igd.mu.Unlock()
+	if actions != "AddPortMapping,AddPortMapping,GetExternalIPAddress" {
+		t.Fatalf("actions %s", actions)
+	}
+	if mapped != "127.0.0.1:40000" {
+		t.Fatalf("mapped to %q", mapped)
+	}
+
+	testRunExitHooks(n)
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	if len(igd.mappings) != 0 || igd.actions[len(igd.actions)-1] != "DeletePortMapping" {
+		t.Fatalf("mappings %v left after exit, actions %v", igd.mappings, igd.actions)
+	}
+}
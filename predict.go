@@ -0,0 +1,167 @@
+package main
+//
+// Port prediction for punching through symmetric NATs
+//
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	natUnknown = iota
+	natCone // same mapping for every destination
+	natIncremental // new mapping per destination, ports allocated in steps
+	natRandom // new mapping per destination, ports allocated at random
+	natPreserving // public port equals local port, or no NAT at all
+)
+
+const (
+	predictProbes = 4 // fresh sockets used to sample port allocation
+	predictMaxDelta = 16 // larger steps between samples count as random
+)
+
+type PredictConfig struct {
+	Range int // remote ports to spray, in sequence and at random
+	Sockets int // local sockets to open when our NAT allocates at random
+	Step int // port step of the peer's NAT, 0 to guess
+}
+
+// Params:
+//   on[,range=64,sockets=16,step=N]
+func parsePredict(s string) *PredictConfig {
+	params := strings.Split(s, ",")
+	switch params[0] {
+	case "off", "":
+		return nil
+	case "on":
+	default:
+		perror("Unknown prediction mode:", params[0])
+		os.Exit(1)
+	}
+
+	pc := &PredictConfig{Range: 64, Sockets: 16}
+	for _, v := range params[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			perror("Unknown prediction parameters:", v)
+			os.Exit(1)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n == 0 || (n < 0 && kv[0] != "step") { // steps may go down
+			perror("Invalid prediction parameters:", v)
+			os.Exit(1)
+		}
+		switch kv[0] {
+		case "range":
+			pc.Range = n
+		case "sockets":
+			pc.Sockets = n
+		case "step":
+			pc.Step = n
+		default:
+			perror("Unknown prediction parameters:", v)
+			os.Exit(1)
+		}
+	}
+	return pc
+}
+
+type natPattern struct {
+	kind int
+	delta int // port step of an incremental NAT
+}
+func (p natPattern) String() string {
+	switch p.kind {
+	case natCone:
+		return "cone (endpoint independent mapping)"
+	case natIncremental:
+		return fmt.Sprintf("symmetric, incremental ports (step %+d)", p.delta)
+	case natRandom:
+		return "symmetric, random ports"
+	case natPreserving:
+		return "port preserving"
+	}
+	return "unknown"
+}
+
+// Work out how our NAT allocates ports. @mapped are the addresses STUN
+// servers saw for the punch socket, further samples come from fresh sockets
+// on @laddr's IP querying the first server one after another.
+func probeNAT(laddr *net.UDPAddr, servers []string, mapped []net.Addr) natPattern {
+	if len(servers) == 0 {
+		return natPattern{kind: natUnknown}
+	}
+	if len(mapped) >= 2 {
+		cone := true
+		for _, a := range mapped[1:] {
+			if a.String() != mapped[0].String() {
+				cone = false
+			}
+		}
+		if cone {
+			return natPattern{kind: natCone}
+		}
+	}
+
+	var ports []int
+	preserving := true
+	for i:=0; i<predictProbes; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+		if err != nil {
+			continue
+		}
+		addr, err := stunQueryUDP(conn, servers[0])
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		PrintDbgf("nat: probe %d mapped to %s\n", i, addr)
+		ports = append(ports, addr.Port)
+		if addr.Port != conn.LocalAddr().(*net.UDPAddr).Port {
+			preserving = false
+		}
+	}
+	if len(ports) < 2 {
+		return natPattern{kind: natUnknown}
+	}
+	if preserving {
+		return natPattern{kind: natPreserving}
+	}
+
+	delta := ports[1] - ports[0]
+	for i:=2; i<len(ports); i++ {
+		if d := ports[i] - ports[i-1]; d-delta > 2 || delta-d > 2 {
+			return natPattern{kind: natRandom}
+		}
+	}
+	if delta == 0 || delta > predictMaxDelta || delta < -predictMaxDelta {
+		return natPattern{kind: natRandom}
+	}
+	return natPattern{kind: natIncremental, delta: delta}
+}
+
+// Remote addresses worth spraying besides @raddr: the next @n ports an
+// incremental NAT stepping by @delta would hand out, and @n random ports
+// for birthday hits on a random one.
+func predictPorts(raddr *net.UDPAddr, n int, delta int) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	seen := map[int]bool{raddr.Port: true}
+	add := func(port int) {
+		if port > 0 && port <= 65535 && !seen[port] {
+			seen[port] = true
+			addrs = append(addrs, &net.UDPAddr{IP: raddr.IP, Port: port, Zone: raddr.Zone})
+		}
+	}
+	for i:=1; i<=n; i++ {
+		add(raddr.Port + i*delta)
+	}
+	for i:=0; i<n*2 && len(addrs) < 2*n; i++ {
+		add(1024 + rand.Intn(65536-1024))
+	}
+	return addrs
+}
@@ -0,0 +1,614 @@
+package main
+//
+// Relay server splicing two peers that can't punch through, its client,
+// and migration back to a direct path
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relayDefaultPort = 7778
+	relayWait = 5 * time.Minute // how long a peer waits for the other one
+	relayRetry = 1 * time.Second // udp RELAY resend interval
+	relayExpire = 10 * time.Second // forget unpaired udp members not heard from
+	relayIdle = 2 * time.Minute // drop udp pairs without traffic
+	relayDirectRetry = 10 * time.Second // pause between direct punch attempts
+	relayDirectWait = 5 * time.Second // for the server to answer a TRY
+	relayDirectTries = 10 // HELO rounds of a direct attempt, ~20s
+	relayDirectTimeout = 40 * time.Second // for both sides to finish an attempt
+	relayLinger = 10 * time.Second // keep reading the relay after migrating
+)
+
+var errRelayTimeout = errors.New("relay: timeout waiting for peer")
+
+type RelayConfig struct {
+	Server string
+	Room string
+}
+
+// Params:
+//   host[:port][,room=NAME]
+// The room defaults to the -rendezvous one.
+func parseRelay(s string, rendezvous *RendezvousConfig) *RelayConfig {
+	if s == "" {
+		return nil
+	}
+	params := strings.Split(s, ",")
+	rc := &RelayConfig{Server: params[0]}
+	if _, _, err := net.SplitHostPort(rc.Server); err != nil {
+		rc.Server = net.JoinHostPort(rc.Server, fmt.Sprint(relayDefaultPort))
+	}
+	for _, v := range params[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 && kv[0] == "room" {
+			rc.Room = kv[1]
+		} else {
+			perror("Unknown relay parameters:", v)
+			os.Exit(1)
+		}
+	}
+	if rc.Room == "" && rendezvous != nil {
+		rc.Room = rendezvous.Room
+	}
+	if rc.Room == "" || strings.ContainsAny(rc.Room, " \t\r\n") {
+		perror("Relay needs a room name without spaces, e.g. -relay=host:port,room=NAME")
+		os.Exit(1)
+	}
+	return rc
+}
+
+// Messages are text lines:
+//   peer -> relay: RELAY <room> udp
+//   relay -> peer: WAIT | PAIRED | ERR <reason>
+// After PAIRED the relay passes everything else through untouched, the
+// handshake and encryption stay between the peers.
+func parseRelayReply(line string) (bool, error) {
+	fs := strings.Fields(line)
+	switch {
+	case len(fs) >= 1 && fs[0] == "ERR":
+		return false, errors.New("relay: " + strings.Join(fs[1:], " "))
+	case len(fs) == 1 && fs[0] == "WAIT":
+		PrintDbgf("relay: waiting for peer\n")
+		return false, nil
+	case len(fs) == 1 && fs[0] == "PAIRED":
+		return true, nil
+	}
+	return false, errors.New("relay: unexpected message")
+}
+
+func isRelayReply(b []byte) bool {
+	return string(b) == "PAIRED\n" || string(b) == "WAIT\n"
+}
+
+// Wait in room at the relay over UDP, handshake with the peer through it,
+// then keep trying to punch a direct path in the background.
+func RelayUDP(conf *UDPConfig) (net.Conn, error) {
+	rc := conf.Relay
+	saddr, err := net.ResolveUDPAddr("udp", rc.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("relay: waiting in room '%s' at %s\n", rc.Room, saddr)
+
+	join := []byte(fmt.Sprintf("RELAY %s udp\n", rc.Room))
+	buf := make([]byte, 1024)
+	paired := false
+	for start:=time.Now(); !paired && time.Since(start) < relayWait; {
+		if _, err = conn.WriteTo(join, saddr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		deadline := time.Now().Add(relayRetry)
+		conn.SetReadDeadline(deadline)
+		for !paired && time.Now().Before(deadline) {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if addr.String() != saddr.String() {
+				continue
+			}
+			if paired, err = parseRelayReply(string(buf[:n])); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	if !paired {
+		conn.Close()
+		return nil, errRelayTimeout
+	}
+	fmt.Printf("relay: paired through %s\n", saddr)
+
+	hs, err := newHandshake(conf.Key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hs.identity, hs.authorized = conf.Identity, conf.AuthPeers
+	pu := newUDPPuncher(hs, conf)
+	pu.add(conn)
+	pu.targets = []*net.UDPAddr{saddr}
+	pu.skip = isRelayReply // late answers to our RELAY
+	p, err := pu.run()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	k, err := hs.sessionKey(p.peer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conf.sessKey = k
+
+	peer := conf.RAddr
+	if peer == nil {
+		peer = saddr
+	}
+	conf.peer = peer
+	pc := newPathConn(peer, sessionConnUDP(conn, conf, k, hs.encrypts(p.peer)), saddr)
+	go pc.retryDirect(conf)
+	return pc, nil
+}
+
+// One attempt at a direct path, numbered by the client.
+type directTry struct {
+	n int
+	start time.Time
+	asked bool // client: TRY sent, no GO yet
+	conn net.Conn // the direct path, once punched through
+	peer *net.UDPAddr
+	mine, theirs string // "OK" or "FAIL", empty while unknown
+	acked bool // the peer knows our outcome
+	done bool
+	ended time.Time
+}
+
+type directResult struct {
+	n int
+	conn net.Conn
+	peer *net.UDPAddr
+	err error
+}
+
+// Punch again now and then and move the tunnel onto the direct path once
+// both sides got through. The client starts each attempt over the relayed
+// path so both punch at the same moment, see pathControl for the messages.
+func (pc *pathConn) retryDirect(conf *UDPConfig) {
+	if conf.RAddr == nil && conf.Rendezvous == nil {
+		return // nothing to punch towards
+	}
+	client := conf.Op == "client"
+	results := make(chan directResult)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var t *directTry
+	moved, stop := false, false
+	punch := func(t *directTry) {
+		fmt.Printf("relay: trying a direct path (attempt %d)\n", t.n)
+		go func(n int) {
+			c := *conf
+			c.PortMap = nil // already mapped by the first attempt
+			c.punchTries = relayDirectTries
+			conn, err := PunchUDP(&c)
+			select {
+			case results <- directResult{n, conn, c.peer, err}:
+			case <-pc.closed:
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}(t.n)
+	}
+	// end attempt @t, saying why if we stay on the relay
+	finish := func(t *directTry, why string) {
+		if t.conn != nil && !moved {
+			t.conn.Close()
+		}
+		if !moved && why != "" {
+			fmt.Printf("relay: attempt %d: %s, staying on the relay\n", t.n, why)
+		}
+		t.done, t.ended = true, time.Now()
+	}
+
+	for {
+		select {
+		case <-pc.closed:
+			if t != nil && !t.done {
+				finish(t, "")
+			}
+			return
+
+		case r := <-results:
+			if t == nil || r.n != t.n || t.done {
+				if r.conn != nil {
+					r.conn.Close()
+				}
+				break
+			}
+			t.mine = "OK"
+			if r.err != nil {
+				t.mine = "FAIL"
+				if !errors.Is(r.err, errPunchTimeout) {
+					perror("relay: direct path failed, not trying again.", r.err)
+					stop = true
+				} else {
+					PrintDbgf("relay: attempt %d: %v\n", t.n, r.err)
+				}
+			} else {
+				fmt.Printf("relay: attempt %d: punched through to %s, waiting for the peer\n", t.n, r.peer)
+			}
+			t.conn, t.peer = r.conn, r.peer
+			pc.sendStatus(t, false)
+
+		case msg := <-pc.ctl:
+			fs := strings.Fields(msg)
+			if len(fs) < 2 {
+				break
+			}
+			n, err := strconv.Atoi(fs[1])
+			if err != nil {
+				break
+			}
+			switch {
+			case fs[0] == "TRY" && !client && !moved && !stop:
+				if t == nil || n > t.n {
+					if t != nil && !t.done {
+						finish(t, "superseded")
+					}
+					t = &directTry{n: n, start: time.Now()}
+					pc.control("GO %d", n)
+					punch(t)
+				} else if n == t.n {
+					pc.control("GO %d", n) // our GO got lost
+				}
+			case fs[0] == "GO" && client && t != nil && n == t.n && t.asked:
+				t.asked = false
+				punch(t)
+			case (fs[0] == "OK" || fs[0] == "FAIL") && len(fs) == 4 && t != nil && n == t.n:
+				t.theirs = fs[0]
+				if fs[2] == "1" {
+					t.acked = true
+				}
+				if t.mine != "" && fs[3] == "0" {
+					pc.sendStatus(t, true)
+				}
+			}
+
+		case <-ticker.C:
+			if client && !moved && !stop && (t == nil || t.done && time.Since(t.ended) >= relayDirectRetry) {
+				n := 1
+				if t != nil {
+					n = t.n + 1
+				}
+				t = &directTry{n: n, start: time.Now(), asked: true}
+			}
+			if t == nil || t.done {
+				break
+			}
+			switch {
+			case t.asked && time.Since(t.start) > relayDirectWait:
+				finish(t, "peer didn't answer")
+			case t.asked:
+				pc.control("TRY %d", t.n)
+			case time.Since(t.start) > relayDirectTimeout && t.mine == "":
+				finish(t, "punching took too long")
+			case time.Since(t.start) > relayDirectTimeout:
+				finish(t, "no word from the peer")
+			case t.mine != "" && !(t.theirs != "" && t.acked):
+				pc.sendStatus(t, false)
+			}
+		}
+
+		if t == nil || t.done {
+			continue
+		}
+		if t.mine == "OK" && t.theirs == "OK" && !moved {
+			fmt.Printf("relay: migrated to direct path %s <--> %s\n", t.conn.LocalAddr(), t.peer)
+			pc.migrate(t.conn.(net.PacketConn), t.peer)
+			moved = true
+		}
+		if t.mine != "" && t.theirs != "" && t.acked {
+			switch {
+			case t.mine == "FAIL":
+				finish(t, "no direct path")
+			case t.theirs == "FAIL":
+				finish(t, "peer didn't get through")
+			default:
+				finish(t, "")
+			}
+		}
+	}
+}
+
+// Tell the peer how attempt @t went, and whether we know how it went for
+// them. @reply marks answers, which are not answered again.
+func (pc *pathConn) sendStatus(t *directTry, reply bool) {
+	got, re := 0, 0
+	if t.theirs != "" {
+		got = 1
+	}
+	if reply {
+		re = 1
+	}
+	pc.control("%s %d %d %d", t.mine, t.n, got, re)
+}
+
+type timeoutError struct{}
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errPathClosed = errors.New("use of closed path")
+
+// Datagrams on a path start with their kind, tunnel data or a control
+// message lining up direct punch attempts:
+//   client -> server: TRY <n>
+//   server -> client: GO <n>, both punch right away
+//   both: OK|FAIL <n> <got> <reply>, sent until the peer has it, <got> is
+//   1 once the peer's outcome is known, replies are not answered again
+// Both sides move to the direct path if both say OK.
+const (
+	pathData = 0
+	pathControl = 1
+)
+
+// A datagram path to the peer that can be swapped for a better one while
+// the tunnel runs. Layers above always see @peer as the remote address, each
+// path does its own encryption below.
+type pathConn struct {
+	peer *net.UDPAddr
+	in chan []byte
+	ctl chan string
+	relay net.PacketConn // control messages always go through the relay,
+	relayTo net.Addr // the peer reads its direct path only once it moved
+
+	mu sync.Mutex
+	conn net.PacketConn // current path
+	to net.Addr // where the current path sends
+	rdeadline time.Time
+	closed chan struct{}
+	once sync.Once
+}
+
+func newPathConn(peer *net.UDPAddr, conn net.PacketConn, to net.Addr) *pathConn {
+	pc := &pathConn{peer: peer, conn: conn, to: to, relay: conn, relayTo: to,
+		in: make(chan []byte, 256), ctl: make(chan string, 16), closed: make(chan struct{})}
+	go pc.pump(conn, to)
+	return pc
+}
+
+// feed datagrams from one path to the readers until it's closed
+func (pc *pathConn) pump(conn net.PacketConn, from net.Addr) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		if addr.String() != from.String() || n == 0 {
+			continue
+		}
+		if buf[0] == pathControl {
+			select {
+			case pc.ctl <- string(buf[1:n]):
+			default:
+			}
+			continue
+		}
+		p := make([]byte, n-1)
+		copy(p, buf[1:n])
+		select {
+		case pc.in <- p:
+		case <-pc.closed:
+			return
+		}
+	}
+}
+
+// Send over @conn to @to from now on, the old path keeps being read for a
+// while as packets still in flight arrive.
+func (pc *pathConn) migrate(conn net.PacketConn, to net.Addr) {
+	pc.mu.Lock()
+	old := pc.conn
+	pc.conn, pc.to = conn, to
+	pc.mu.Unlock()
+	go pc.pump(conn, to)
+	time.AfterFunc(relayLinger, func() {
+		old.Close()
+	})
+}
+
+func (pc *pathConn) path() (net.PacketConn, net.Addr) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.conn, pc.to
+}
+
+func (pc *pathConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc.mu.Lock()
+	deadline := pc.rdeadline
+	pc.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-pc.in:
+		return copy(b, p), pc.peer, nil
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	case <-pc.closed:
+		return 0, nil, errPathClosed
+	}
+}
+func (pc *pathConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn, to := pc.path()
+	p := make([]byte, 1+len(b))
+	p[0] = pathData
+	copy(p[1:], b)
+	if _, err := conn.WriteTo(p, to); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+// send a control message to the peer
+func (pc *pathConn) control(format string, a ...interface{}) {
+	pc.relay.WriteTo(append([]byte{pathControl}, fmt.Sprintf(format, a...)...), pc.relayTo)
+}
+func (pc *pathConn) Read(b []byte) (int, error) {
+	n, _, err := pc.ReadFrom(b)
+	return n, err
+}
+func (pc *pathConn) Write(b []byte) (int, error) {
+	return pc.WriteTo(b, pc.peer)
+}
+func (pc *pathConn) Close() error {
+	pc.once.Do(func() {
+		close(pc.closed)
+	})
+	conn, _ := pc.path()
+	return conn.Close()
+}
+func (pc *pathConn) LocalAddr() net.Addr {
+	conn, _ := pc.path()
+	return conn.LocalAddr()
+}
+func (pc *pathConn) RemoteAddr() net.Addr {
+	return pc.peer
+}
+func (pc *pathConn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+func (pc *pathConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	pc.rdeadline = t
+	pc.mu.Unlock()
+	return nil
+}
+func (pc *pathConn) SetWriteDeadline(t time.Time) error {
+	conn, _ := pc.path()
+	return conn.SetWriteDeadline(t)
+}
+
+type relayMember struct {
+	addr string
+	seen time.Time
+}
+
+type relayServer struct {
+	mu sync.Mutex
+	waiting map[string]*relayMember // udp room -> member waiting in it
+	peers map[string]*net.UDPAddr // udp address -> its peer's
+	seen map[string]time.Time // last traffic of paired udp addresses
+}
+
+// caller must hold rs.mu
+func (rs *relayServer) expire() {
+	now := time.Now()
+	for room, m := range rs.waiting {
+		if now.Sub(m.seen) > relayExpire {
+			delete(rs.waiting, room)
+		}
+	}
+	for a, t := range rs.seen {
+		if now.Sub(t) > relayIdle {
+			PrintDbgf("relay: %s idle, unpaired\n", a)
+			delete(rs.peers, a)
+			delete(rs.seen, a)
+		}
+	}
+}
+
+// Splice peers waiting in the same room. UDP only, a tcp tunnel couldn't
+// move off the relay again.
+func RelayServer(addr string) error {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	uconn, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		return err
+	}
+	defer uconn.Close()
+	fmt.Printf("relay server listening on %s (udp)\n", addr)
+
+	rs := &relayServer{
+		waiting: make(map[string]*relayMember),
+		peers: make(map[string]*net.UDPAddr),
+		seen: make(map[string]time.Time),
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, raddr, err := uconn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		from := raddr.String()
+		rs.mu.Lock()
+		peer := rs.peers[from]
+		if peer != nil {
+			rs.seen[from] = time.Now()
+		}
+		rs.mu.Unlock()
+
+		var fs []string
+		if n < 256 {
+			fs = strings.Fields(string(buf[:n]))
+		}
+		join := len(fs) == 3 && fs[0] == "RELAY" && fs[2] == "udp"
+		if peer != nil && join {
+			uconn.WriteTo([]byte("PAIRED\n"), raddr)
+		} else if peer != nil {
+			uconn.WriteTo(buf[:n], peer)
+		} else if join {
+			rs.joinUDP(uconn, fs[1], raddr)
+		}
+	}
+}
+
+func (rs *relayServer) joinUDP(uconn *net.UDPConn, room string, addr *net.UDPAddr) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.expire()
+	m := rs.waiting[room]
+	if m == nil || m.addr == addr.String() {
+		rs.waiting[room] = &relayMember{addr: addr.String(), seen: time.Now()}
+		uconn.WriteTo([]byte("WAIT\n"), addr)
+		return
+	}
+	delete(rs.waiting, room)
+	other, err := net.ResolveUDPAddr("udp", m.addr)
+	if err != nil {
+		return
+	}
+	rs.peers[addr.String()], rs.peers[m.addr] = other, addr
+	rs.seen[addr.String()], rs.seen[m.addr] = time.Now(), time.Now()
+	fmt.Printf("relay: paired %s <--> %s in udp/%s\n", m.addr, addr, room)
+	uconn.WriteTo([]byte("PAIRED\n"), addr)
+	uconn.WriteTo([]byte("PAIRED\n"), other)
+}
@@ -0,0 +1,389 @@
+package main
+//
+// Rendezvous server pairing two peers by room name, and its client
+//
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rendezvousDefaultPort = 7777
+	rendezvousDelay = 1 * time.Second // both peers start punching after this
+	rendezvousWait = 5 * time.Minute // how long a peer waits for the other one
+	rendezvousRetry = 1 * time.Second // udp JOIN resend interval
+	rendezvousExpire = 10 * time.Second // forget udp members not heard from
+	rendezvousLinger = 30 * time.Second // keep answering a paired room
+)
+
+var errRendezvousTimeout = errors.New("rendezvous: timeout waiting for peer")
+
+type RendezvousConfig struct {
+	Server string
+	Room string
+}
+
+// Params:
+//   host[:port],room=NAME
+func parseRendezvous(s string) *RendezvousConfig {
+	if s == "" {
+		return nil
+	}
+	params := strings.Split(s, ",")
+	rc := &RendezvousConfig{Server: params[0]}
+	if _, _, err := net.SplitHostPort(rc.Server); err != nil {
+		rc.Server = net.JoinHostPort(rc.Server, fmt.Sprint(rendezvousDefaultPort))
+	}
+	for _, v := range params[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 && kv[0] == "room" {
+			rc.Room = kv[1]
+		} else {
+			perror("Unknown rendezvous parameters:", v)
+			os.Exit(1)
+		}
+	}
+	if rc.Room == "" || strings.ContainsAny(rc.Room, " \t\r\n") {
+		perror("Rendezvous needs a room name without spaces, e.g. -rendezvous=host:port,room=NAME")
+		os.Exit(1)
+	}
+	return rc
+}
+
+// Messages are text lines:
+//   peer -> server: JOIN <room> <mode> [candidate ...]
+//   server -> peer: WAIT | PEER <addr> <delay_ms> [candidate ...] | ERR <reason>
+// A peer starts punching <addr> and the other's candidates once <delay_ms>
+// has passed.
+func parsePeerLine(line string) (string, time.Duration, []string, error) {
+	fs := strings.Fields(line)
+	if len(fs) >= 1 && fs[0] == "ERR" {
+		return "", 0, nil, errors.New("rendezvous: " + strings.Join(fs[1:], " "))
+	}
+	if len(fs) < 3 || fs[0] != "PEER" {
+		return "", 0, nil, errors.New("rendezvous: unexpected message")
+	}
+	ms, err := strconv.Atoi(fs[2])
+	if err != nil {
+		return "", 0, nil, errors.New("rendezvous: unexpected message")
+	}
+	return fs[1], time.Duration(ms) * time.Millisecond, fs[3:], nil
+}
+
+func waitPeer(peer string, delay time.Duration) {
+	fmt.Printf("rendezvous: peer at %s, start punching in %v\n", peer, delay)
+	time.Sleep(delay)
+}
+
+// Join room from @conn with our @local candidates and wait for the peer's
+// public address, the server sees the same mapping the tunnel will use.
+// Returns it along with the peer's candidates.
+func rendezvousUDP(conn net.PacketConn, rc *RendezvousConfig, local []candidate) (*net.UDPAddr, []candidate, error) {
+	saddr, err := net.ResolveUDPAddr("udp", rc.Server)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	fmt.Printf("rendezvous: joining room '%s' at %s\n", rc.Room, saddr)
+
+	join := fmt.Sprintf("JOIN %s udp", rc.Room)
+	if len(local) > 0 {
+		join += " " + joinCandidates(local, " ")
+	}
+	join += "\n"
+	buf := make([]byte, 2048)
+	for start:=time.Now(); time.Since(start) < rendezvousWait; {
+		if _, err = conn.WriteTo([]byte(join), saddr); err != nil {
+			return nil, nil, err
+		}
+		deadline := time.Now().Add(rendezvousRetry)
+		conn.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if addr.String() != saddr.String() {
+				continue
+			}
+			line := string(buf[:n])
+			if strings.HasPrefix(line, "WAIT") {
+				PrintDbgf("rendezvous: waiting for peer\n")
+				continue
+			}
+			peer, delay, extra, err := parsePeerLine(line)
+			if err != nil {
+				return nil, nil, err
+			}
+			raddr, err := net.ResolveUDPAddr("udp", peer)
+			if err != nil {
+				return nil, nil, err
+			}
+			cands := []candidate{{candSrflx, raddr}}
+			for _, v := range extra {
+				if c, err := parseCandidate(v); err == nil {
+					cands = append(cands, c)
+				}
+			}
+			waitPeer(peer, delay)
+			return raddr, cands, nil
+		}
+	}
+	return nil, nil, errRendezvousTimeout
+}
+
+// Join room over a TCP connection made from @laddr and wait for the peer's
+// public address.
+func rendezvousTCP(laddr *net.TCPAddr, rc *RendezvousConfig) (*net.TCPAddr, error) {
+	dialer := &net.Dialer{LocalAddr: laddr, Timeout: 10*time.Second, Control: reuseControl}
+	conn, err := dialer.Dial("tcp", rc.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	fmt.Printf("rendezvous: joining room '%s' at %s\n", rc.Room, conn.RemoteAddr())
+
+	conn.SetDeadline(time.Now().Add(rendezvousWait))
+	if _, err = fmt.Fprintf(conn, "JOIN %s tcp\n", rc.Room); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, errRendezvousTimeout
+			}
+			return nil, err
+		}
+		if strings.HasPrefix(line, "WAIT") {
+			PrintDbgf("rendezvous: waiting for peer\n")
+			continue
+		}
+		peer, delay, _, err := parsePeerLine(line)
+		if err != nil {
+			return nil, err
+		}
+		raddr, err := net.ResolveTCPAddr("tcp", peer)
+		if err != nil {
+			return nil, err
+		}
+		waitPeer(peer, delay)
+		return raddr, nil
+	}
+}
+
+type rvMember struct {
+	addr string // public address as seen by the server
+	cands []string // candidates it sent along, passed on as they are
+	seen time.Time
+	keep bool // tcp members stay until their connection closes
+	send func(msg string)
+}
+
+type rvRoom struct {
+	members []*rvMember
+	start time.Time // when both peers start punching, zero until paired
+}
+func (room *rvRoom) notify(m *rvMember) {
+	peer := room.members[0]
+	if peer == m {
+		peer = room.members[1]
+	}
+	delay := time.Until(room.start)
+	if delay < 0 {
+		delay = 0
+	}
+	msg := fmt.Sprintf("PEER %s %d", peer.addr, delay.Milliseconds())
+	if len(peer.cands) > 0 {
+		msg += " " + strings.Join(peer.cands, " ")
+	}
+	m.send(msg + "\n")
+}
+
+type rendezvousServer struct {
+	mu sync.Mutex
+	rooms map[string]*rvRoom
+}
+
+// caller must hold rv.mu
+func (rv *rendezvousServer) expire() {
+	now := time.Now()
+	for key, room := range rv.rooms {
+		if !room.start.IsZero() {
+			if now.Sub(room.start) > rendezvousLinger {
+				delete(rv.rooms, key)
+			}
+			continue
+		}
+		var live []*rvMember
+		for _, m := range room.members {
+			if m.keep || now.Sub(m.seen) < rendezvousExpire {
+				live = append(live, m)
+			}
+		}
+		room.members = live
+		if len(live) == 0 {
+			delete(rv.rooms, key)
+		}
+	}
+}
+
+func (rv *rendezvousServer) join(key string, m *rvMember) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.expire()
+
+	room := rv.rooms[key]
+	if room == nil {
+		room = &rvRoom{}
+		rv.rooms[key] = room
+	}
+	for _, o := range room.members {
+		if o.addr == m.addr {
+			o.seen = time.Now()
+			if !room.start.IsZero() {
+				room.notify(o)
+			} else {
+				o.send("WAIT\n")
+			}
+			return
+		}
+	}
+	if len(room.members) >= 2 {
+		m.send("ERR room full\n")
+		return
+	}
+
+	m.seen = time.Now()
+	room.members = append(room.members, m)
+	PrintDbgf("rendezvous: %s joined %s\n", m.addr, key)
+	if len(room.members) < 2 {
+		m.send("WAIT\n")
+		return
+	}
+	room.start = time.Now().Add(rendezvousDelay)
+	fmt.Printf("rendezvous: paired %s <--> %s in %s\n", room.members[0].addr, room.members[1].addr, key)
+	for _, o := range room.members {
+		room.notify(o)
+	}
+}
+
+// remove a tcp member whose connection closed before it was paired
+func (rv *rendezvousServer) leave(key string, m *rvMember) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	room := rv.rooms[key]
+	if room == nil || !room.start.IsZero() {
+		return
+	}
+	for i, o := range room.members {
+		if o == m {
+			room.members = append(room.members[:i], room.members[i+1:]...)
+			break
+		}
+	}
+	if len(room.members) == 0 {
+		delete(rv.rooms, key)
+	}
+}
+
+// room key and candidates from a JOIN line, peers only meet others of the
+// same mode
+func parseJoin(line string) (string, []string, bool) {
+	fs := strings.Fields(line)
+	if len(fs) < 3 || fs[0] != "JOIN" || !contains(fs[2], []string{"tcp", "udp"}) {
+		return "", nil, false
+	}
+	cands := fs[3:]
+	if len(cands) > iceMaxCandidates {
+		cands = cands[:iceMaxCandidates]
+	}
+	return fs[2] + "/" + fs[1], cands, true
+}
+
+// Pair peers joining the same room on @addr, over both UDP and TCP.
+func RendezvousServer(addr string) error {
+	uconn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer uconn.Close()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("rendezvous server listening on %s (udp+tcp)\n", addr)
+
+	rv := &rendezvousServer{rooms: make(map[string]*rvRoom)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				perror("rendezvous: accept() failed.", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(rendezvousWait))
+				r := bufio.NewReader(conn)
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				key, cands, ok := parseJoin(line)
+				if !ok {
+					conn.Write([]byte("ERR bad request\n"))
+					return
+				}
+				done := make(chan struct{})
+				var once sync.Once
+				m := &rvMember{addr: conn.RemoteAddr().String(), cands: cands, keep: true}
+				m.send = func(msg string) {
+					conn.Write([]byte(msg))
+					if !strings.HasPrefix(msg, "WAIT") {
+						once.Do(func() { close(done) })
+					}
+				}
+				rv.join(key, m)
+
+				// wait for the peer, or for this one to give up
+				closed := make(chan struct{})
+				go func() {
+					r.ReadString('\n')
+					close(closed)
+				}()
+				select {
+				case <-done:
+				case <-closed:
+					rv.leave(key, m)
+				}
+			}()
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	for {
+		n, raddr, err := uconn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key, cands, ok := parseJoin(string(buf[:n]))
+		if !ok {
+			continue
+		}
+		to := raddr
+		rv.join(key, &rvMember{addr: raddr.String(), cands: cands, send: func(msg string) {
+			uconn.WriteTo([]byte(msg), to)
+		}})
+	}
+}
@@ -2,13 +2,11 @@
 
 import (
 	"fmt"
-	"os"
 	"time"
 	"net"
 
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
-	"github.com/shawwwn/gole/s5"
 )
 
 // wrapper for StartServerTCP(), StartServerKCP(), and StartServerUDP()
@@ -27,71 +25,15 @@ func StartServer(conn net.Conn, conf Config) {
 
 func StartServerTCP(conn net.Conn, conf *TCPConfig) {
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.TCPConn:
-			conn = NewEConn(conn, conf.Enc, conf.Key)
-		}
-	}
-
 	// Setup server side of smux
-	var interval int = g_timeout/3
-	interval = bound(interval, 1, 10)
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 1
-	smuxConfig.MaxReceiveBuffer = 4194304
-	smuxConfig.MaxStreamBuffer = 2097152
-	smuxConfig.KeepAliveInterval = time.Duration(interval) * time.Second
-	smuxConfig.KeepAliveTimeout = time.Duration(g_timeout) * time.Second
-	if err := smux.VerifyConfig(smuxConfig); err != nil {
-		perror("smux.VerifyConfig() failed.", err)
-		os.Exit(1)
-	}
-
-	session, err := smux.Server(conn, smuxConfig)
+	session, err := smux.Server(conn, newSmuxConfig())
 	if err != nil {
 		perror("smux.Server() failed.", err)
-		os.Exit(1)
+		exit(1)
 	}
 	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", session.LocalAddr(), session.RemoteAddr())
 
-	if conf.FwdAddr != nil {
-		fmt.Printf("Forward tunnel traffic to %s\n", conf.FwdAddr)
-	} else {
-		fmt.Printf("Forward tunnel traffic to SOCKS5\n")
-	}
-
-	// Accept and forward
-	fmt.Println("Waiting for new stream from tunnel ...")
-	for {
-		// accept a stream
-		stream, err := session.AcceptStream()
-		if err != nil {
-			perror("smux.AcceptStream() failed.", err)
-			break
-		}
-
-		if conf.FwdAddr != nil {
-			// port mapping
-			fwd_conn, err := net.DialTCP("tcp", nil, conf.FwdAddr.(*net.TCPAddr))
-			if err != nil {
-				perror("net.Dial() failed.", err)
-				stream.Close()
-				continue
-			}
-			PrintDbgf("stream open(%d): tunnel --> %v\n", stream.ID(), fwd_conn.RemoteAddr())
-
-			go stream2conn(stream, fwd_conn)
-		} else {
-			// socks5
-			go func() {
-				PrintDbgf("stream open(%d)\n", stream.ID())
-				s5.HandleConnection(stream)
-				PrintDbgf("stream close(%d)\n", stream.ID())
-			}()
-		}
-	}
+	forwardServer(session, conf.FwdAddr, conf.Fwds, conf.RFwds)
 
 	// clean up
 	fmt.Printf("...\n")
@@ -103,39 +45,38 @@ func StartServerTCP(conn net.Conn, conf *TCPConfig) {
 
 func StartServerKCP(conn net.PacketConn, conf *UDPConfig) {
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.UDPConn:
-			conn = NewEPacketConn(conn, conf.Enc, conf.Key)
-		}
-	}
-
 	// setup kcp
-	kconf := getKCPConfig(conf.KConf)
+	kconf := conf.KCP
 	PrintDbgf("%T: %v\n", kconf, kconf)
-	block := getKCPBlockCipher(kconf)
+	block := getKCPBlockCipher(kconf, conf.sessKey)
 	klis, err := kcp.ServeConn(block, kconf.DataShard, kconf.ParityShard, conn)
 	if err != nil {
 		perror("kcp.ServeConn() failed.", err)
-		os.Exit(1)
+		exit(1)
 	}
 
 	if err := SetDSCP(conn.(net.Conn), kconf.DSCP); err != nil {
 		perror("SetDSCP() failed.", err)
 	}
-	if err := klis.SetReadBuffer(kconf.SockBuf); err != nil {
-		perror("klis.SetReadBuffer() failed.", err)
-	}
-	if err := klis.SetWriteBuffer(kconf.SockBuf); err != nil {
-		perror("klis.SetWriteBuffer() failed.", err)
+	if isUDPSocket(conn) {
+		if err := klis.SetReadBuffer(kconf.SockBuf); err != nil {
+			perror("klis.SetReadBuffer() failed.", err)
+		}
+		if err := klis.SetWriteBuffer(kconf.SockBuf); err != nil {
+			perror("klis.SetWriteBuffer() failed.", err)
+		}
 	}
 
 	klis.SetDeadline(time.Now().Add(time.Duration(g_timeout+4) * time.Second))
 	kconn, err := klis.AcceptKCP()
 	if err != nil {
 		perror("klis.AcceptKCP() failed.", err)
-		os.Exit(1)
+		if g_persist {
+			klis.Close()
+			conn.Close()
+			return
+		}
+		exit(1)
 	}
 	kconn.SetStreamMode(true)
 	kconn.SetWriteDelay(false)
@@ -145,62 +86,14 @@ func StartServerKCP(conn net.PacketConn, conf *UDPConfig) {
 	kconn.SetACKNoDelay(kconf.AckNodelay)
 
 	// Setup server side of smux
-	var interval int = g_timeout/3
-	interval = bound(interval, 1, 10)
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = 1
-	smuxConfig.MaxReceiveBuffer = 4194304
-	smuxConfig.MaxStreamBuffer = 2097152
-	smuxConfig.KeepAliveInterval = time.Duration(interval) * time.Second
-	smuxConfig.KeepAliveTimeout = time.Duration(g_timeout) * time.Second
-	if err := smux.VerifyConfig(smuxConfig); err != nil {
-		perror("smux.VerifyConfig() failed.", err)
-		os.Exit(1)
-	}
-
-	sess, err := smux.Server(kconn, smuxConfig)
+	sess, err := smux.Server(kconn, newSmuxConfig())
 	if err != nil {
 		perror("smux.Server() failed.", err)
-		os.Exit(1)
+		exit(1)
 	}
 	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", sess.LocalAddr(), sess.RemoteAddr())
 
-	if conf.FwdAddr != nil {
-		fmt.Printf("Forward tunnel traffic to %s\n", conf.FwdAddr)
-	} else {
-		fmt.Printf("Forward tunnel traffic to SOCKS5\n")
-	}
-
-	// Accept and forward
-	fmt.Println("Waiting for new stream from tunnel ...")
-	for {
-		stream, err := sess.AcceptStream()
-		if err != nil {
-			perror("smux.AcceptStream() failed.", err)
-			break
-		}
-
-		if conf.FwdAddr != nil {
-			// port mapping
-			fwd_conn, err := net.DialTCP("tcp", nil, conf.FwdAddr.(*net.TCPAddr))
-			if err != nil {
-				perror("net.Dial() failed.", err)
-				stream.Close()
-				continue
-			}
-			PrintDbgf("stream open(%d): tunnel --> %v\n", stream.ID(), fwd_conn.RemoteAddr())
-
-			go stream2conn(stream, fwd_conn)
-		} else {
-			// socks5
-			go func() {
-				PrintDbgf("stream open(%d)\n", stream.ID())
-				s5.HandleConnection(stream)
-				PrintDbgf("stream close(%d)\n", stream.ID())
-			}()
-		}
-
-	} // AcceptStream()
+	forwardServer(sess, conf.FwdAddr, conf.Fwds, conf.RFwds)
 
 	// clean up
 	fmt.Printf("...\n")
@@ -213,71 +106,70 @@ func StartServerKCP(conn net.PacketConn, conf *UDPConfig) {
 
 func StartServerUDP(conn net.PacketConn, conf *UDPConfig) {
 
-	// encrypt socket
-	if conf.Key != "" {
-		switch conn.(type) {
-		case *net.UDPConn:
-			conn = NewEPacketConn(conn, conf.Enc, conf.Key)
-		}
-	}
-
-	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", conf.LocalAddr(), conf.RemoteAddr())
+	fmt.Printf("tunnel created: [local]%v <--> [remote]%v\n", conn.LocalAddr(), conf.peer)
 	fmt.Printf("Connect to forward address %s\n", conf.FwdAddr)
 
-	fwd_conn, err := net.DialUDP("udp", nil, conf.FwdAddr.(*net.UDPAddr))
-	if err != nil {
-		perror("net.DialUDP() failed.", err)
-		os.Exit(1)
-	}
-
-	// recreate socket with sendto() on same endpoints
-	// conn.Close()
-	// conn, err = net.DialUDP("udp", conf.LAddr, conf.RAddr)
-
-	// TODO: Needs udp muxing.
+	// a socket to the forward address for each flow from the client
+	flows := newUDPFlows()
+	go flows.expire(time.Duration(g_timeout) * time.Second)
+	defer flows.close()
 
-	// conn --> fwd_conn
-	go func() {
-		defer conn.Close()
-		defer fwd_conn.Close()
-		buf := make([]byte, 4096)
+	// fwd_conn --> conn
+	pump := func(f *udpFlow) {
+		buf := make([]byte, udpFlowHeader+4096)
+		putFlowID(buf, f.id)
 		for {
-			conn.SetDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
-			n, _, err := conn.ReadFrom(buf)
+			n, err := f.conn.Read(buf[udpFlowHeader:])
 			if err != nil {
-				fmt.Println("conn.Read() failed.", err)
+				PrintDbgf("flow close(%d)\n", f.id)
+				flows.remove(f)
 				return
 			}
-			_, err = fwd_conn.Write(buf[:n])
+			f.touch()
+			_, err = conn.WriteTo(buf[:udpFlowHeader+n], conf.peer)
 			if err != nil {
-				fmt.Println("fwd_conn.Write() failed.", err)
+				fmt.Println("conn.Write() failed.", err)
+				conn.Close()
 				return
 			}
 		}
-	}()
+	}
 
-	// fwd_conn --> conn
+	// conn --> fwd_conn, only traffic from the peer keeps the tunnel alive
 	func() {
 		defer conn.Close()
-		defer fwd_conn.Close()
-		buf := make([]byte, 4096)
+		buf := make([]byte, udpFlowHeader+4096)
 		for {
-			n, err := fwd_conn.Read(buf)
+			conn.SetReadDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
+			n, _, err := conn.ReadFrom(buf)
 			if err != nil {
-				fmt.Println("fwd_conn.Read() failed.", err)
+				fmt.Println("conn.Read() failed.", err)
 				return
 			}
-
-			_, err = conn.WriteTo(buf[:n], conf.RAddr)
+			if n < udpFlowHeader {
+				continue
+			}
+			f := flows.get(getFlowID(buf))
+			if f == nil {
+				fwd_conn, err := net.DialUDP("udp", nil, conf.FwdAddr.(*net.UDPAddr))
+				if err != nil {
+					perror("net.DialUDP() failed.", err)
+					continue
+				}
+				f = &udpFlow{id: getFlowID(buf), conn: fwd_conn}
+				flows.add(f)
+				PrintDbgf("flow open(%d): tunnel --> %v\n", f.id, fwd_conn.LocalAddr())
+				go pump(f)
+			}
+			f.touch()
+			_, err = f.conn.Write(buf[udpFlowHeader:n])
 			if err != nil {
-				fmt.Println("conn.Write() failed.", err)
-				return
+				fmt.Println("fwd_conn.Write() failed.", err)
 			}
-			conn.SetDeadline(time.Now().Add(time.Duration(g_timeout) * time.Second))
 		}
 	}()
 
 	fmt.Println("...")
-	fmt.Printf("tunnel collapsed: [local]%v <--> [remote]%v\n", conf.LocalAddr(), conf.RemoteAddr())
+	fmt.Printf("tunnel collapsed: [local]%v <--> [remote]%v\n", conn.LocalAddr(), conf.peer)
 	time.Sleep(time.Second)
 }
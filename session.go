@@ -0,0 +1,548 @@
+package main
+//
+// Forwarding over an smux session, shared by 'tcp' and 'kcp' tunnels
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+	"github.com/shawwwn/gole/s5"
+)
+
+const (
+	fwdHeader = 2 // forward id at the start of each stream, big endian
+	fwdPlain = 0xffff // id count in a layout for a plain -fwd
+
+	persistStall = 2 * time.Minute // how long new connections wait for a re-punch
+	persistMaxBackoff = time.Minute
+)
+
+// One of several forwards in a tunnel (-fwd=ID:addr). The client listens
+// on addr and tags its streams with id, the server dials its own addr for
+// that id. An id of 0 is the single legacy -fwd, both sides have to agree
+// on one or the other.
+type fwdTarget struct {
+	id uint16
+	addr net.Addr // *net.TCPAddr, or *net.UDPAddr for "udp:" forwards
+}
+
+// repeatable -fwd flag
+type fwdFlag []string
+func (f *fwdFlag) String() string {
+	return strings.Join(*f, ",")
+}
+func (f *fwdFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// Params:
+//   IP:PORT|udp:IP:PORT|socks5[...]
+//   ID:IP:PORT|ID:udp:IP:PORT (repeatable)
+// Returns the legacy -fwd as is for the caller to parse, or the forwards
+// with ids.
+func parseForwards(list []string) (string, []fwdTarget) {
+	var fwds []fwdTarget
+	seen := make(map[uint16]bool)
+	for _, s := range list {
+		i := strings.Index(s, ":")
+		id, err := uint64(0), errors.New("no id")
+		if i > 0 {
+			id, err = strconv.ParseUint(s[:i], 10, 16)
+		}
+		if err != nil {
+			if len(list) > 1 {
+				perror("Multiple -fwd need an id each (-fwd=ID:addr):", s)
+				os.Exit(1)
+			}
+			return s, nil
+		}
+		if id == 0 || seen[uint16(id)] {
+			perror("Invalid or duplicate -fwd id:", s)
+			os.Exit(1)
+		}
+		seen[uint16(id)] = true
+
+		var addr net.Addr
+		if rest := s[i+1:]; strings.HasPrefix(rest, "udp:") {
+			addr, err = net.ResolveUDPAddr("udp", strings.TrimPrefix(rest, "udp:"))
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", rest)
+		}
+		if err != nil {
+			perror("Invalid -fwd address.", err)
+			os.Exit(1)
+		}
+		fwds = append(fwds, fwdTarget{uint16(id), addr})
+	}
+	return "", fwds
+}
+
+// Params:
+//   listen_addr:target_addr|udp:listen_addr:target_addr (repeatable)
+// The same list goes to both sides, ids are positions in it. The server
+// keeps the listen addresses and the client the targets.
+func parseReverseForwards(list []string, op string) []fwdTarget {
+	var rfwds []fwdTarget
+	for n, s := range list {
+		udp := strings.HasPrefix(s, "udp:")
+		rest := strings.TrimPrefix(s, "udp:")
+
+		// split where both halves are host:port
+		var listen, target string
+		for i := 0; i < len(rest); i++ {
+			if rest[i] != ':' {
+				continue
+			}
+			_, _, err1 := net.SplitHostPort(rest[:i])
+			_, _, err2 := net.SplitHostPort(rest[i+1:])
+			if err1 == nil && err2 == nil {
+				listen, target = rest[:i], rest[i+1:]
+				break
+			}
+		}
+		if listen == "" {
+			perror("Invalid -rfwd, expecting listen_addr:target_addr:", s)
+			os.Exit(1)
+		}
+
+		a := target
+		if op == "server" {
+			a = listen
+		}
+		var addr net.Addr
+		var err error
+		if udp {
+			addr, err = net.ResolveUDPAddr("udp", a)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", a)
+		}
+		if err != nil {
+			perror("Invalid -rfwd address.", err)
+			os.Exit(1)
+		}
+		rfwds = append(rfwds, fwdTarget{uint16(n+1), addr})
+	}
+	return rfwds
+}
+
+func newSmuxConfig() *smux.Config {
+	var interval int = g_timeout/3
+	interval = bound(interval, 1, 10)
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = 1
+	smuxConfig.MaxReceiveBuffer = 4194304
+	smuxConfig.MaxStreamBuffer = 2097152
+	smuxConfig.KeepAliveInterval = time.Duration(interval) * time.Second
+	smuxConfig.KeepAliveTimeout = time.Duration(g_timeout) * time.Second
+	if err := smux.VerifyConfig(smuxConfig); err != nil {
+		perror("smux.VerifyConfig() failed.", err)
+		exit(1)
+	}
+	return smuxConfig
+}
+
+// The session forward listeners open streams on. With -persist one tunnel
+// lives for the whole run, listeners stay open and each re-punched session
+// replaces the collapsed one.
+type tunnel struct {
+	persist bool
+	mu sync.Mutex
+	sess *smux.Session
+	changed chan struct{} // closed by set()
+}
+
+var g_tunnel *tunnel // -persist only
+
+func newTunnel(sess *smux.Session, persist bool) *tunnel {
+	return &tunnel{persist: persist, sess: sess, changed: make(chan struct{})}
+}
+
+func (t *tunnel) set(sess *smux.Session) {
+	t.mu.Lock()
+	t.sess = sess
+	close(t.changed)
+	t.changed = make(chan struct{})
+	t.mu.Unlock()
+}
+
+// whether listeners should close, never with -persist
+func (t *tunnel) done() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.persist && t.sess.IsClosed()
+}
+
+// Open a stream for forward @id, with -persist a dead session is waited
+// out for up to persistStall while re-punching.
+func (t *tunnel) open(id uint16) (*smux.Stream, error) {
+	timeout := time.After(persistStall)
+	for {
+		t.mu.Lock()
+		sess, changed := t.sess, t.changed
+		t.mu.Unlock()
+		stream, err := openFwdStream(sess, id)
+		if err == nil || !t.persist {
+			return stream, err
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, err
+		}
+	}
+}
+
+func waitClosed(sess *smux.Session) {
+	for !sess.IsClosed() {
+		time.Sleep(2*time.Second)
+	}
+}
+
+// open a stream for forward @id, the id goes first even if it is 0
+func openFwdStream(sess *smux.Session, id uint16) (*smux.Stream, error) {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	var hdr [fwdHeader]byte
+	binary.BigEndian.PutUint16(hdr[:], id)
+	if _, err := stream.Write(hdr[:]); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// forwards configured differently on the two sides
+type fwdMismatchError string
+func (e fwdMismatchError) Error() string {
+	return "forwards don't match the peer's: " + string(e)
+}
+
+// Forward layout the client sends on the first stream of a session:
+//   [2-byte id count, fwdPlain for a plain -fwd][2-byte ids][2-byte -rfwd count]
+// The server answers with [1-byte len][mismatch], empty if they match.
+func sendForwards(sess *smux.Session, fwds []fwdTarget, rfwds []fwdTarget) error {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	b := make([]byte, 2, 4+2*len(fwds))
+	binary.BigEndian.PutUint16(b, uint16(len(fwds)))
+	if len(fwds) == 1 && fwds[0].id == 0 {
+		binary.BigEndian.PutUint16(b, fwdPlain)
+	} else {
+		for _, f := range fwds {
+			b = append(b, byte(f.id>>8), byte(f.id))
+		}
+	}
+	b = append(b, byte(len(rfwds)>>8), byte(len(rfwds)))
+	if _, err := stream.Write(b); err != nil {
+		return err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reason, err := readVarString(stream)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return fwdMismatchError(reason)
+	}
+	return nil
+}
+
+// check the client's forward layout against @fwd, @fwds and @rfwds
+func checkForwards(sess *smux.Session, fwd net.Addr, fwds []fwdTarget, rfwds []fwdTarget) error {
+	stream, err := sess.AcceptStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var hdr [2]byte
+	if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	var ids []byte
+	if n != fwdPlain {
+		ids = make([]byte, 2*n)
+	}
+	if _, err := io.ReadFull(stream, ids); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+		return err
+	}
+	nrfwd := int(binary.BigEndian.Uint16(hdr[:]))
+
+	reason := ""
+	switch {
+	case n == fwdPlain && len(fwds) > 0:
+		reason = "client has a plain -fwd, server has -fwd=ID:addr"
+	case n > 0 && n != fwdPlain && len(fwds) == 0:
+		reason = "client has -fwd=ID:addr, server has a plain -fwd or socks5"
+	case nrfwd != len(rfwds):
+		reason = fmt.Sprintf("client has %d -rfwd, server has %d", nrfwd, len(rfwds))
+	}
+	for i := 0; reason == "" && i < len(ids); i += 2 {
+		id := binary.BigEndian.Uint16(ids[i:])
+		if _, err := lookupFwd(id, fwd, fwds); err != nil {
+			reason = fmt.Sprintf("client has -fwd id %d, server doesn't", id)
+		}
+	}
+
+	if _, err := stream.Write(append([]byte{byte(len(reason))}, reason...)); err != nil {
+		return err
+	}
+	if reason != "" {
+		return fwdMismatchError(reason)
+	}
+	return nil
+}
+
+// read a [1-byte len][string]
+func readVarString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// which of @fwds a stream is for, @fwd if there are no ids
+func readFwdID(stream *smux.Stream, fwd net.Addr, fwds []fwdTarget) (net.Addr, error) {
+	var hdr [fwdHeader]byte
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	return lookupFwd(binary.BigEndian.Uint16(hdr[:]), fwd, fwds)
+}
+
+// forward @id stands for, @fwd if there are no ids
+func lookupFwd(id uint16, fwd net.Addr, fwds []fwdTarget) (net.Addr, error) {
+	switch {
+	case id == 0 && len(fwds) == 0:
+		return fwd, nil
+	case id == 0:
+		return nil, fwdMismatchError("peer has a plain -fwd, we have -fwd=ID:addr")
+	case len(fwds) == 0:
+		return nil, fwdMismatchError("peer has -fwd=ID:addr, we have a plain -fwd or socks5")
+	}
+	for _, f := range fwds {
+		if f.id == id {
+			return f.addr, nil
+		}
+	}
+	return nil, fwdMismatchError("no forward with id " + strconv.Itoa(int(id)) + " on this side")
+}
+
+// Client side of a tunnel, listens on every forward and dials reverse
+// forwards until @sess closes.
+func forwardClient(sess *smux.Session, fwd net.Addr, fwds []fwdTarget, rfwds []fwdTarget) {
+	if len(fwds) == 0 && !(len(rfwds) > 0 && nilAddr(fwd)) {
+		fwds = []fwdTarget{{0, fwd}}
+	}
+	if err := sendForwards(sess, fwds, rfwds); err != nil {
+		if _, ok := err.(fwdMismatchError); ok {
+			perror("Tunnel refused.", err)
+			exit(1)
+		}
+		perror("sendForwards() failed.", err)
+		return
+	}
+	for _, f := range rfwds {
+		fmt.Printf("Reverse forward tunnel traffic to %s (id %d)\n", f.addr, f.id)
+	}
+	if len(rfwds) > 0 {
+		go acceptStreams(sess, nil, rfwds)
+	}
+	serveListeners(sess, fwds)
+}
+
+// Server side of a tunnel, forwards streams and listens on every reverse
+// forward until @sess closes. A nil @fwd without @fwds means SOCKS5.
+func forwardServer(sess *smux.Session, fwd net.Addr, fwds []fwdTarget, rfwds []fwdTarget) {
+	if err := checkForwards(sess, fwd, fwds, rfwds); err != nil {
+		if _, ok := err.(fwdMismatchError); ok {
+			perror("Tunnel refused.", err)
+			exit(1)
+		}
+		perror("checkForwards() failed.", err)
+		return
+	}
+	for _, f := range fwds {
+		fmt.Printf("Forward tunnel traffic to %s (id %d)\n", f.addr, f.id)
+	}
+	if len(fwds) == 0 && fwd != nil {
+		fmt.Printf("Forward tunnel traffic to %s\n", fwd)
+	} else if len(fwds) == 0 {
+		fmt.Printf("Forward tunnel traffic to SOCKS5\n")
+	}
+	go serveListeners(sess, rfwds)
+	acceptStreams(sess, fwd, fwds)
+}
+
+// Listen on @fwds until @sess closes. With -persist the listeners are
+// opened for the first session and move on to later ones.
+func serveListeners(sess *smux.Session, fwds []fwdTarget) {
+	if g_persist {
+		if g_tunnel == nil {
+			g_tunnel = newTunnel(sess, true)
+			for _, f := range fwds {
+				go listenStreams(g_tunnel, f)
+			}
+		} else {
+			g_tunnel.set(sess)
+		}
+		waitClosed(sess)
+		return
+	}
+
+	t := newTunnel(sess, false)
+	var wg sync.WaitGroup
+	for _, f := range fwds {
+		wg.Add(1)
+		go func(f fwdTarget) {
+			defer wg.Done()
+			listenStreams(t, f)
+		}(f)
+	}
+	wg.Wait()
+	waitClosed(sess)
+}
+
+func listenStreams(t *tunnel, f fwdTarget) {
+	if addr, ok := f.addr.(*net.UDPAddr); ok {
+		udp2streams(t, addr, f.id)
+	} else {
+		tcp2streams(t, f.addr.(*net.TCPAddr), f.id)
+	}
+}
+
+// whether -fwd was left out
+func nilAddr(a net.Addr) bool {
+	switch v := a.(type) {
+	case *net.TCPAddr:
+		return v == nil || v.Port == 0
+	case *net.UDPAddr:
+		return v == nil || v.Port == 0
+	}
+	return a == nil
+}
+
+// a stream for each connection to @addr
+func tcp2streams(t *tunnel, addr *net.TCPAddr, id uint16) {
+	// listen from forward
+	lis, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		perror("net.Listen() failed.", err)
+		exit(1)
+	}
+	defer lis.Close()
+	fmt.Printf("Waiting for new connections from %s ...\n", addr)
+
+	// periodic check if smux session is still alive
+	go func() {
+		for {
+			time.Sleep(2*time.Second)
+			if t.done() {
+				lis.Close()
+				fmt.Printf("tunnel is closed\n")
+				break
+			}
+		}
+	}()
+
+	for {
+		fwd_conn, err := lis.Accept()
+		if err != nil {
+			perror("lis.Accept() failed.", err)
+			break
+		}
+
+		// may wait for the tunnel to come back with -persist
+		go func() {
+			stream, err := t.open(id)
+			if err != nil {
+				perror("sess.OpenStream() failed.", err)
+				fwd_conn.Close()
+				return
+			}
+			PrintDbgf("stream open(%d): %v --> tunnel\n", stream.ID(), fwd_conn.RemoteAddr())
+			conn2stream(fwd_conn, stream)
+		}()
+	} // AcceptTCP()
+}
+
+// Serve streams the peer opens, for @fwds by their id or for @fwd if
+// there are no ids.
+func acceptStreams(sess *smux.Session, fwd net.Addr, fwds []fwdTarget) {
+	flows := newUDPFlows()
+	go flows.expire(time.Duration(g_timeout) * time.Second)
+	defer flows.close()
+
+	// Accept and forward
+	fmt.Println("Waiting for new stream from tunnel ...")
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			perror("smux.AcceptStream() failed.", err)
+			break
+		}
+
+		go func() {
+			target, err := readFwdID(stream, fwd, fwds)
+			if err != nil {
+				perror("readFwdID() failed.", err)
+				stream.Close()
+				return
+			}
+			serveStream(stream, target, flows)
+		}()
+	} // AcceptStream()
+}
+
+func serveStream(stream *smux.Stream, target net.Addr, flows *udpFlows) {
+	switch addr := target.(type) {
+	case *net.UDPAddr:
+		// datagrams over the stream
+		stream2udp(stream, addr, flows)
+	case *net.TCPAddr:
+		// port mapping
+		fwd_conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			perror("net.Dial() failed.", err)
+			stream.Close()
+			return
+		}
+		PrintDbgf("stream open(%d): tunnel --> %v\n", stream.ID(), fwd_conn.RemoteAddr())
+		stream2conn(stream, fwd_conn)
+	default:
+		// socks5
+		PrintDbgf("stream open(%d)\n", stream.ID())
+		s5.HandleConnection(stream)
+		PrintDbgf("stream close(%d)\n", stream.ID())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+func TestCheckForwards(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	one := []fwdTarget{{1, tcp}}
+	two := []fwdTarget{{1, tcp}, {2, tcp}}
+	tests := []struct {
+		name string
+		cfwds, crfwds []fwdTarget // client's
+		sfwd net.Addr // server's
+		sfwds, srfwds []fwdTarget
+		ok bool
+	}{
+		{"plain", []fwdTarget{{0, tcp}}, nil, tcp, nil, nil, true},
+		{"ids", one, nil, nil, two, nil, true},
+		{"reverse only", nil, one, tcp, nil, one, true},
+		{"plain vs ids", []fwdTarget{{0, tcp}}, nil, nil, one, nil, false},
+		{"ids vs plain", one, nil, tcp, nil, nil, false},
+		{"missing id", two, nil, nil, one, nil, false},
+		{"rfwd count", []fwdTarget{{0, tcp}}, nil, tcp, nil, one, false},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		cli, err := smux.Client(a, smux.DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := smux.Server(b, smux.DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errc := make(chan error, 1)
+		go func() { errc <- checkForwards(srv, tt.sfwd, tt.sfwds, tt.srfwds) }()
+		cerr := sendForwards(cli, tt.cfwds, tt.crfwds)
+		serr := <-errc
+		cli.Close()
+		srv.Close()
+
+		if tt.ok && (cerr != nil || serr != nil) {
+			t.Errorf("%s: client %v, server %v, want a match", tt.name, cerr, serr)
+		}
+		if !tt.ok {
+			if _, ok := cerr.(fwdMismatchError); !ok {
+				t.Errorf("%s: client got %v, want a mismatch", tt.name, cerr)
+			}
+			if _, ok := serr.(fwdMismatchError); !ok {
+				t.Errorf("%s: server got %v, want a mismatch", tt.name, serr)
+			}
+		}
+	}
+}
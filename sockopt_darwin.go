@@ -0,0 +1,43 @@
+package main
+
+import "net"
+import "syscall"
+import "time"
+import "golang.org/x/sys/unix"
+
+// dialer/listener control, lets several sockets share a local address
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func getsockoptTTL(fd uintptr, v6 bool) (int, error) {
+	if v6 {
+		return unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS)
+	}
+	return unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL)
+}
+func setsockoptTTL(fd uintptr, v6 bool, ttl int) error {
+	if v6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl)
+}
+
+// ICMP errors can't be read from a plain socket here, ttl discovery falls
+// back to a raw ICMP socket.
+func enableRecvErr(conn *net.UDPConn, v6 bool) error {
+	return errNoRecvErr
+}
+func readRecvErr(conn *net.UDPConn, timeout time.Duration) ([]byte, net.IP, bool, error) {
+	return nil, nil, false, errNoRecvErr
+}
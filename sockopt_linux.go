@@ -0,0 +1,102 @@
+package main
+
+import "net"
+import "syscall"
+import "time"
+import "golang.org/x/sys/unix"
+
+// dialer/listener control, lets several sockets share a local address
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func getsockoptTTL(fd uintptr, v6 bool) (int, error) {
+	if v6 {
+		return unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS)
+	}
+	return unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL)
+}
+func setsockoptTTL(fd uintptr, v6 bool, ttl int) error {
+	if v6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl)
+}
+
+// Queue ICMP errors about datagrams sent on @conn, see readRecvErr().
+func enableRecvErr(conn *net.UDPConn, v6 bool) error {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := c.Control(func(fd uintptr) {
+		if v6 {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+		} else {
+			err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Wait up to @timeout for a queued ICMP error, returns the payload of the
+// datagram it was about, who sent it, and whether that was the destination
+// itself (port unreachable) rather than a router on the way.
+func readRecvErr(conn *net.UDPConn, timeout time.Duration) ([]byte, net.IP, bool, error) {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	var n, oobn int
+	cerr := c.Control(func(fd uintptr) {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLERR}}
+		if _, err = unix.Poll(fds, int(timeout/time.Millisecond)); err != nil {
+			return
+		}
+		if fds[0].Revents&unix.POLLERR == 0 {
+			err = timeoutError{}
+			return
+		}
+		n, oobn, _, _, err = unix.Recvmsg(int(fd), buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	})
+	if cerr != nil {
+		return nil, nil, false, cerr
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for _, m := range msgs {
+		// struct sock_extended_err, then the offender's sockaddr
+		d := m.Data
+		if len(d) < 16 {
+			continue
+		}
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_RECVERR && d[4] == unix.SO_EE_ORIGIN_ICMP && len(d) >= 24:
+			return buf[:n], net.IP(append([]byte(nil), d[20:24]...)), d[5] == 3, nil
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_RECVERR && d[4] == unix.SO_EE_ORIGIN_ICMP6 && len(d) >= 40:
+			return buf[:n], net.IP(append([]byte(nil), d[24:40]...)), d[5] == 1, nil
+		}
+	}
+	return nil, nil, false, errNoRecvErr
+}
@@ -0,0 +1,39 @@
+package main
+
+import "net"
+import "syscall"
+import "time"
+
+// dialer/listener control, lets several sockets share a local address
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func getsockoptTTL(fd uintptr, v6 bool) (int, error) {
+	if v6 {
+		return syscall.GetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS)
+	}
+	return syscall.GetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL)
+}
+func setsockoptTTL(fd uintptr, v6 bool, ttl int) error {
+	if v6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
+
+// ICMP errors can't be read from a plain socket here, ttl discovery falls
+// back to a raw ICMP socket.
+func enableRecvErr(conn *net.UDPConn, v6 bool) error {
+	return errNoRecvErr
+}
+func readRecvErr(conn *net.UDPConn, timeout time.Duration) ([]byte, net.IP, bool, error) {
+	return nil, nil, false, errNoRecvErr
+}
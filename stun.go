@@ -0,0 +1,444 @@
+package main
+//
+// STUN (RFC 5389) binding client and a minimal responder
+//
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	stunMagic = 0x2112A442
+	stunHeaderSize = 20
+	stunBindingRequest = 0x0001
+	stunBindingSuccess = 0x0101
+	stunAttrMappedAddr = 0x0001
+	stunAttrResponseAddr = 0x0002 // RFC 3489, reply to this address instead
+	stunAttrChangeRequest = 0x0003 // RFC 5780, reply from the alternate IP and/or port
+	stunAttrXorMappedAddr = 0x0020
+	stunAttrSoftware = 0x8022
+	stunAttrOtherAddr = 0x802C // RFC 5780, the server's alternate address
+	stunChangeIP = 0x04
+	stunChangePort = 0x02
+	stunDefaultPort = 3478
+)
+
+var errStunMessage = errors.New("stun: malformed message")
+var errStunTimeout = errors.New("stun: no response from server")
+
+type stunAttr struct {
+	typ uint16
+	val []byte
+}
+
+// A STUN message:
+//   [2-byte type][2-byte length][4-byte magic cookie][12-byte transaction id]
+//   attributes: [2-byte type][2-byte length][value, padded to 4 bytes]
+type stunMessage struct {
+	typ uint16
+	txid []byte
+	attrs []stunAttr
+}
+func (m *stunMessage) marshal() []byte {
+	var body []byte
+	for _, a := range m.attrs {
+		hdr := make([]byte, 4)
+		binary.BigEndian.PutUint16(hdr, a.typ)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(a.val)))
+		body = append(append(body, hdr...), a.val...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	b := make([]byte, stunHeaderSize, stunHeaderSize+len(body))
+	binary.BigEndian.PutUint16(b, m.typ)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(body)))
+	binary.BigEndian.PutUint32(b[4:], stunMagic)
+	copy(b[8:], m.txid)
+	return append(b, body...)
+}
+func (m *stunMessage) attr(typ uint16) []byte {
+	for _, a := range m.attrs {
+		if a.typ == typ {
+			return a.val
+		}
+	}
+	return nil
+}
+
+func parseStunMessage(b []byte) (*stunMessage, error) {
+	if len(b) < stunHeaderSize || b[0]&0xc0 != 0 || binary.BigEndian.Uint32(b[4:]) != stunMagic {
+		return nil, errStunMessage
+	}
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if n%4 != 0 || stunHeaderSize+n > len(b) {
+		return nil, errStunMessage
+	}
+	m := &stunMessage{typ: binary.BigEndian.Uint16(b), txid: b[8:stunHeaderSize]}
+	body := b[stunHeaderSize:stunHeaderSize+n]
+	for len(body) >= 4 {
+		typ := binary.BigEndian.Uint16(body)
+		alen := int(binary.BigEndian.Uint16(body[2:]))
+		if 4+alen > len(body) {
+			return nil, errStunMessage
+		}
+		m.attrs = append(m.attrs, stunAttr{typ, body[4:4+alen]})
+		alen = (alen+3) &^ 3
+		if 4+alen > len(body) {
+			break
+		}
+		body = body[4+alen:]
+	}
+	return m, nil
+}
+
+func newStunRequest() *stunMessage {
+	txid := make([]byte, 12)
+	rand.Read(txid)
+	return &stunMessage{typ: stunBindingRequest, txid: txid}
+}
+
+// encode an address attribute, xor'ed with the magic cookie and @txid if set
+func stunAddr(ip net.IP, port int, txid []byte) []byte {
+	fam, addr := byte(1), ip.To4()
+	if addr == nil {
+		fam, addr = 2, ip.To16()
+	}
+	b := append([]byte{0, fam, 0, 0}, addr...)
+	binary.BigEndian.PutUint16(b[2:], uint16(port))
+	if txid != nil {
+		stunXor(b[2:], txid)
+	}
+	return b
+}
+
+func parseStunAddr(b []byte, txid []byte) (net.IP, int, error) {
+	if len(b) < 8 || (b[1] == 1 && len(b) != 8) || (b[1] == 2 && len(b) != 20) {
+		return nil, 0, errStunMessage
+	}
+	p := append([]byte(nil), b[2:]...)
+	if txid != nil {
+		stunXor(p, txid)
+	}
+	return net.IP(p[2:]), int(binary.BigEndian.Uint16(p)), nil
+}
+
+// xor port and address with magic cookie + transaction id
+func stunXor(p []byte, txid []byte) {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key, stunMagic)
+	copy(key[4:], txid)
+	p[0] ^= key[0]
+	p[1] ^= key[1]
+	for i:=2; i<len(p); i++ {
+		p[i] ^= key[i-2]
+	}
+}
+
+// mapped address in a binding response to @req
+func (m *stunMessage) mapped(req *stunMessage) (net.IP, int, error) {
+	if m.typ != stunBindingSuccess || !bytes.Equal(m.txid, req.txid) {
+		return nil, 0, errStunMessage
+	}
+	if a := m.attr(stunAttrXorMappedAddr); a != nil {
+		return parseStunAddr(a, m.txid)
+	}
+	if a := m.attr(stunAttrMappedAddr); a != nil {
+		return parseStunAddr(a, nil)
+	}
+	return nil, 0, errStunMessage
+}
+
+// binding response telling the requester it is seen as @ip:@port, @other
+// is our alternate address if we have one
+func stunResponse(req *stunMessage, ip net.IP, port int, other *net.UDPAddr) *stunMessage {
+	m := &stunMessage{
+		typ: stunBindingSuccess,
+		txid: req.txid,
+		attrs: []stunAttr{
+			{stunAttrXorMappedAddr, stunAddr(ip, port, req.txid)},
+			{stunAttrMappedAddr, stunAddr(ip, port, nil)},
+			{stunAttrSoftware, []byte("gole")},
+		},
+	}
+	if other != nil {
+		m.attrs = append(m.attrs, stunAttr{stunAttrOtherAddr, stunAddr(other.IP, other.Port, nil)})
+	}
+	return m
+}
+
+// flags of a CHANGE-REQUEST attribute
+func (m *stunMessage) change() byte {
+	if a := m.attr(stunAttrChangeRequest); len(a) == 4 {
+		return a[3]
+	}
+	return 0
+}
+
+// Accept "host" or "host:port", defaulting to the standard STUN port.
+func stunServerAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, fmt.Sprint(stunDefaultPort))
+	}
+	return server
+}
+
+// Send @req to @saddr from @conn until a response arrives, retransmitting
+// like RFC 5389 suggests. The response may come from another address of
+// the server, datagrams not answering @req are left unanswered.
+func stunTransact(conn net.PacketConn, saddr *net.UDPAddr, req *stunMessage, tries int) (*stunMessage, net.Addr, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1024)
+	rto := 500 * time.Millisecond
+	for i:=0; i<tries; i++ {
+		if _, err := conn.WriteTo(req.marshal(), saddr); err != nil {
+			return nil, nil, err
+		}
+		deadline := time.Now().Add(rto)
+		conn.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			m, err := parseStunMessage(buf[:n])
+			if err != nil || !bytes.Equal(m.txid, req.txid) {
+				continue
+			}
+			return m, addr, nil
+		}
+		rto *= 2
+	}
+	return nil, nil, errStunTimeout
+}
+
+// Ask @server for the public address of @conn.
+func stunQueryUDP(conn net.PacketConn, server string) (*net.UDPAddr, error) {
+	saddr, err := net.ResolveUDPAddr("udp", stunServerAddr(server))
+	if err != nil {
+		return nil, err
+	}
+	req := newStunRequest()
+	m, _, err := stunTransact(conn, saddr, req, 4)
+	if err != nil {
+		return nil, err
+	}
+	ip, port, err := m.mapped(req)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// Ask @server for the public address of a TCP connection made from @laddr,
+// the socket shares @laddr with the tunnel so it gets the same mapping.
+func stunQueryTCP(laddr *net.TCPAddr, server string) (*net.TCPAddr, error) {
+	dialer := &net.Dialer{LocalAddr: laddr, Timeout: 5*time.Second, Control: reuseControl}
+	conn, err := dialer.Dial("tcp", stunServerAddr(server))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := newStunRequest()
+	if _, err = conn.Write(req.marshal()); err != nil {
+		return nil, err
+	}
+	m, err := readStunMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	ip, port, err := m.mapped(req)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readStunMessage(r io.Reader) (*stunMessage, error) {
+	hdr := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	b := make([]byte, stunHeaderSize+int(binary.BigEndian.Uint16(hdr[2:])))
+	copy(b, hdr)
+	if _, err := io.ReadFull(r, b[stunHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return parseStunMessage(b)
+}
+
+// Query every server in @servers with @query and report the mapped
+// addresses. Differing answers mean the NAT maps each destination to a new
+// port.
+func stunDiscover(servers []string, query func(server string) (net.Addr, error)) []net.Addr {
+	var mapped []net.Addr
+	for _, server := range servers {
+		addr, err := query(server)
+		if err != nil {
+			perror("stun: query "+server+" failed.", err)
+			continue
+		}
+		fmt.Printf("stun: public address %s (via %s)\n", addr, server)
+		if len(mapped) > 0 && mapped[0].String() != addr.String() {
+			perror(fmt.Sprintf("stun: mapping changed from %s to %s, symmetric NAT detected, plain hole punching will likely fail (see -predict)", mapped[0], addr))
+		}
+		mapped = append(mapped, addr)
+	}
+	return mapped
+}
+
+// A STUN responder, UDP sockets on every combination of its primary and
+// alternate IP and port, TCP on the primary address only.
+type stunServer struct {
+	socks [2][2]net.PacketConn // [ip][port], 0 for the primary and 1 for the alternate value
+	ln net.Listener
+	other *net.UDPAddr // alternate address, nil without
+}
+
+// Bind a stun server to @addr, and to @alt if set so clients can run the
+// RFC 5780 filtering tests with CHANGE-REQUEST.
+func newStunServer(addr, alt string) (*stunServer, error) {
+	primary, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &stunServer{}
+	ips, ports := []net.IP{primary.IP}, []int{primary.Port}
+	if alt != "" {
+		if ss.other, err = net.ResolveUDPAddr("udp", alt); err != nil {
+			return nil, err
+		}
+		if !ss.other.IP.Equal(primary.IP) {
+			ips = append(ips, ss.other.IP)
+		}
+		if ss.other.Port != primary.Port {
+			ports = append(ports, ss.other.Port)
+		}
+	}
+	for i, ip := range ips {
+		for j, port := range ports {
+			uconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				ss.Close()
+				return nil, err
+			}
+			ss.socks[i][j] = uconn
+		}
+	}
+	if ss.ln, err = net.Listen("tcp", addr); err != nil {
+		ss.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (ss *stunServer) Close() {
+	for i := range ss.socks {
+		for j := range ss.socks[i] {
+			if ss.socks[i][j] != nil {
+				ss.socks[i][j].Close()
+			}
+		}
+	}
+	if ss.ln != nil {
+		ss.ln.Close()
+	}
+}
+
+// Answer binding requests until Close().
+func (ss *stunServer) serve() error {
+	go func() {
+		for {
+			conn, err := ss.ln.Accept()
+			if err != nil {
+				PrintDbgf("stun: accept() failed. %v\n", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				req, err := readStunMessage(conn)
+				if err != nil || req.typ != stunBindingRequest {
+					return
+				}
+				raddr := conn.RemoteAddr().(*net.TCPAddr)
+				PrintDbgf("stun: binding request from tcp %s\n", raddr)
+				conn.Write(stunResponse(req, raddr.IP, raddr.Port, nil).marshal())
+			}()
+		}
+	}()
+
+	serve := func(i, j int) error {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := ss.socks[i][j].ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			req, err := parseStunMessage(buf[:n])
+			if err != nil || req.typ != stunBindingRequest {
+				continue
+			}
+			raddr := addr.(*net.UDPAddr)
+			PrintDbgf("stun: binding request from udp %s (change %#x)\n", raddr, req.change())
+
+			// answer from the alternate IP/port if asked to
+			ri, rj := i, j
+			if req.change()&stunChangeIP != 0 {
+				ri ^= 1
+			}
+			if req.change()&stunChangePort != 0 {
+				rj ^= 1
+			}
+			out := ss.socks[ri][rj]
+			if out == nil {
+				continue
+			}
+
+			// only redirect to the requester's own host, never reflect elsewhere
+			to := raddr
+			if a := req.attr(stunAttrResponseAddr); a != nil {
+				if ip, port, err := parseStunAddr(a, nil); err == nil && ip.Equal(raddr.IP) {
+					to = &net.UDPAddr{IP: ip, Port: port}
+				}
+			}
+			out.WriteTo(stunResponse(req, raddr.IP, raddr.Port, ss.other).marshal(), to)
+		}
+	}
+	errc := make(chan error, 4)
+	for i := range ss.socks {
+		for j := range ss.socks[i] {
+			if ss.socks[i][j] != nil {
+				go func(i, j int) {
+					errc <- serve(i, j)
+				}(i, j)
+			}
+		}
+	}
+	return <-errc
+}
+
+// Answer binding requests on @addr over both UDP and TCP. With @alt set,
+// UDP is also served on the alternate IP and/or port.
+func StunServer(addr, alt string) error {
+	ss, err := newStunServer(addr, alt)
+	if err != nil {
+		return err
+	}
+	defer ss.Close()
+	fmt.Printf("stun server listening on %s (udp+tcp)\n", addr)
+	if ss.other != nil {
+		fmt.Printf("stun server alternate address %s (udp)\n", ss.other)
+	}
+	return ss.serve()
+}
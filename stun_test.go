@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Start a stun server on a random port of 127.0.0.1, with an alternate
+// address on @altIP and the next port if @altIP is set.
+func testStunServer(t *testing.T, altIP string) (*stunServer, *net.UDPAddr) {
+	t.Helper()
+	for i:=0; i<20; i++ {
+		port := 20000 + rand.Intn(30000)
+		alt := ""
+		if altIP != "" {
+			alt = fmt.Sprintf("%s:%d", altIP, port+1)
+		}
+		ss, err := newStunServer(fmt.Sprintf("127.0.0.1:%d", port), alt)
+		if err != nil {
+			continue
+		}
+		go ss.serve()
+		t.Cleanup(ss.Close)
+		return ss, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	}
+	t.Fatal("no free port for the stun server")
+	return nil, nil
+}
+
+func testUDPConn(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Answer every datagram on a local socket with what @reply returns.
+func testResponder(t *testing.T, reply func(req []byte) [][]byte) *net.UDPAddr {
+	t.Helper()
+	conn := testUDPConn(t)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, b := range reply(buf[:n]) {
+				conn.WriteTo(b, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestStunAddr(t *testing.T) {
+	txid := newStunRequest().txid
+	for _, ip := range []net.IP{net.IPv4(203, 0, 113, 7), net.ParseIP("2001:db8::1")} {
+		for _, x := range [][]byte{nil, txid} {
+			b := stunAddr(ip, 54321, x)
+			if x != nil && bytes.Equal(b, stunAddr(ip, 54321, nil)) {
+				t.Fatalf("%s: xor left the address unchanged", ip)
+			}
+			got, port, err := parseStunAddr(b, x)
+			if err != nil || !got.Equal(ip) || port != 54321 {
+				t.Fatalf("%s: got %s:%d, %v", ip, got, port, err)
+			}
+		}
+	}
+}
+
+func TestStunXorMappedAddress(t *testing.T) {
+	_, saddr := testStunServer(t, "")
+	conn := testUDPConn(t)
+
+	req := newStunRequest()
+	m, from, err := stunTransact(conn, saddr, req, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != saddr.String() {
+		t.Fatalf("response from %s, want %s", from, saddr)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	ip, port, err := parseStunAddr(m.attr(stunAttrXorMappedAddr), m.txid)
+	if err != nil || !ip.Equal(local.IP) || port != local.Port {
+		t.Fatalf("XOR-MAPPED-ADDRESS %s:%d, %v, want %s", ip, port, err, local)
+	}
+	ip, port, err = parseStunAddr(m.attr(stunAttrMappedAddr), nil)
+	if err != nil || !ip.Equal(local.IP) || port != local.Port {
+		t.Fatalf("MAPPED-ADDRESS %s:%d, %v, want %s", ip, port, err, local)
+	}
+	if m.attr(stunAttrOtherAddr) != nil {
+		t.Fatal("OTHER-ADDRESS without an alternate address")
+	}
+
+	mapped, err := stunQueryUDP(conn, saddr.String())
+	if err != nil || mapped.String() != local.String() {
+		t.Fatalf("stunQueryUDP() = %v, %v, want %s", mapped, err, local)
+	}
+}
+
+func TestStunChangeRequest(t *testing.T) {
+	_, saddr := testStunServer(t, "127.0.0.2")
+	alt := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: saddr.Port+1}
+	conn := testUDPConn(t)
+
+	for _, c := range []struct {
+		change byte
+		from string
+	}{
+		{0, saddr.String()},
+		{stunChangePort, fmt.Sprintf("127.0.0.1:%d", alt.Port)},
+		{stunChangeIP, fmt.Sprintf("127.0.0.2:%d", saddr.Port)},
+		{stunChangeIP|stunChangePort, alt.String()},
+	} {
+		req := newStunRequest()
+		req.attrs = append(req.attrs, stunAttr{stunAttrChangeRequest, []byte{0, 0, 0, c.change}})
+		m, from, err := stunTransact(conn, saddr, req, 4)
+		if err != nil {
+			t.Fatalf("change %#x: %v", c.change, err)
+		}
+		if from.String() != c.from {
+			t.Fatalf("change %#x: response from %s, want %s", c.change, from, c.from)
+		}
+		ip, port, err := parseStunAddr(m.attr(stunAttrOtherAddr), nil)
+		if err != nil || !ip.Equal(alt.IP) || port != alt.Port {
+			t.Fatalf("change %#x: OTHER-ADDRESS %s:%d, %v, want %s", c.change, ip, port, err, alt)
+		}
+	}
+}
+
+func TestStunResponseAddress(t *testing.T) {
+	_, saddr := testStunServer(t, "")
+	conn := testUDPConn(t)
+	to := testUDPConn(t)
+	taddr := to.LocalAddr().(*net.UDPAddr)
+
+	// redirected to another port of the requester's host
+	req := newStunRequest()
+	req.attrs = append(req.attrs, stunAttr{stunAttrResponseAddr, stunAddr(taddr.IP, taddr.Port, nil)})
+	if _, _, err := stunTransact(conn, saddr, req, 1); err != errStunTimeout {
+		t.Fatalf("response came back to the requester, %v", err)
+	}
+	to.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := to.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("no response at RESPONSE-ADDRESS.", err)
+	}
+	m, err := parseStunMessage(buf[:n])
+	if err != nil || !bytes.Equal(m.txid, req.txid) {
+		t.Fatalf("unexpected response at RESPONSE-ADDRESS, %v", err)
+	}
+
+	// never reflected to another host
+	req = newStunRequest()
+	req.attrs = append(req.attrs, stunAttr{stunAttrResponseAddr, stunAddr(net.IPv4(127, 0, 0, 3), taddr.Port, nil)})
+	if _, _, err := stunTransact(conn, saddr, req, 4); err != nil {
+		t.Fatal("response to another host not sent back to the requester.", err)
+	}
+}
+
+func TestStunTransactionMismatch(t *testing.T) {
+	var right int32
+	saddr := testResponder(t, func(b []byte) [][]byte {
+		req, err := parseStunMessage(b)
+		if err != nil {
+			return nil
+		}
+		other := newStunRequest()
+		stale := stunResponse(other, net.IPv4(192, 0, 2, 1), 1, nil).marshal()
+		if atomic.LoadInt32(&right) == 0 {
+			return [][]byte{stale}
+		}
+		return [][]byte{stale, stunResponse(req, net.IPv4(198, 51, 100, 1), 4242, nil).marshal()}
+	})
+	conn := testUDPConn(t)
+
+	req := newStunRequest()
+	if _, _, err := stunTransact(conn, saddr, req, 1); err != errStunTimeout {
+		t.Fatalf("stunTransact() = %v, want %v", err, errStunTimeout)
+	}
+
+	atomic.StoreInt32(&right, 1)
+	m, _, err := stunTransact(conn, saddr, req, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, port, err := m.mapped(req)
+	if err != nil || !ip.Equal(net.IPv4(198, 51, 100, 1)) || port != 4242 {
+		t.Fatalf("mapped() = %s:%d, %v", ip, port, err)
+	}
+	if _, _, err := m.mapped(newStunRequest()); err != errStunMessage {
+		t.Fatalf("mapped() for another request = %v, want %v", err, errStunMessage)
+	}
+}
+
+func TestStunTruncated(t *testing.T) {
+	req := newStunRequest()
+	good := stunResponse(req, net.IPv4(198, 51, 100, 1), 4242, nil).marshal()
+	if _, err := parseStunMessage(good); err != nil {
+		t.Fatal(err)
+	}
+
+	// first attribute claims more bytes than the message holds
+	long := append([]byte(nil), good...)
+	long[stunHeaderSize+3] = 0xff
+	// message shorter than its header says
+	short := good[:len(good)-4]
+	// address attribute cut short
+	cut := (&stunMessage{typ: stunBindingSuccess, txid: req.txid, attrs: []stunAttr{
+		{stunAttrXorMappedAddr, stunAddr(net.IPv4(198, 51, 100, 1), 4242, req.txid)[:6]},
+	}}).marshal()
+
+	for name, b := range map[string][]byte{"header": good[:stunHeaderSize-1], "attribute": long, "length": short} {
+		if _, err := parseStunMessage(b); err != errStunMessage {
+			t.Fatalf("%s: parseStunMessage() = %v, want %v", name, err, errStunMessage)
+		}
+	}
+	m, err := parseStunMessage(cut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.mapped(req); err != errStunMessage {
+		t.Fatalf("mapped() of a cut address = %v, want %v", err, errStunMessage)
+	}
+
+	// truncated responses are skipped, not taken as an answer
+	saddr := testResponder(t, func(b []byte) [][]byte {
+		return [][]byte{long, short}
+	})
+	conn := testUDPConn(t)
+	if _, _, err := stunTransact(conn, saddr, req, 1); err != errStunTimeout {
+		t.Fatalf("stunTransact() = %v, want %v", err, errStunTimeout)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+//
+// TLS 1.3 over a punched TCP socket
+//
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var errTLSPin = errors.New("tls: certificate does not match pinned fingerprint")
+var errTLSBinding = errors.New("tls: channel binding failed")
+
+type TLSConfig struct {
+	Self bool // server: use an ephemeral self-signed certificate
+	Cert string // server: certificate file
+	Key string // server: private key file
+	Pin []byte // client: sha256 of the server's certificate
+	CA string // client: CA file to verify the server's certificate
+	Name string // client: DNS name the CA-verified certificate must carry
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("%x", sum)
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: "gole"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(24 * time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+// Check the server's certificate against the pin or CA, if configured.
+// Otherwise the channel binding alone authenticates the server. With a CA
+// the certificate must also be issued to Name, else any certificate from
+// that CA would pass, a pin can stand in for Name.
+func (tc *TLSConfig) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("tls: no certificate")
+	}
+	if tc.Pin != nil {
+		sum := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(sum[:], tc.Pin) {
+			return errTLSPin
+		}
+	}
+	if tc.CA != "" {
+		pem, err := ioutil.ReadFile(tc.CA)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.New("tls: no certificate in " + tc.CA)
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		inters := x509.NewCertPool()
+		for _, raw := range rawCerts[1:] {
+			if c, err := x509.ParseCertificate(raw); err == nil {
+				inters.AddCert(c)
+			}
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters, DNSName: tc.Name})
+		return err
+	}
+	return nil
+}
+
+// Run a TLS handshake over @conn, as client if @client is set. @sessKey
+// is the key negotiated in the HELO handshake, both sides prove they hold
+// it over the TLS exporter so nobody can splice into the punched socket.
+func tlsHandshake(conn net.Conn, tc *TLSConfig, client bool, sessKey []byte) (net.Conn, error) {
+	var tconn *tls.Conn
+	if client {
+		tconn = tls.Client(conn, &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			ServerName: tc.Name,
+			InsecureSkipVerify: true, // verified below
+			VerifyPeerCertificate: tc.verify,
+		})
+	} else {
+		var cert tls.Certificate
+		var err error
+		if tc.Self || tc.Cert == "" {
+			cert, err = selfSignedCert()
+		} else {
+			cert, err = tls.LoadX509KeyPair(tc.Cert, tc.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("tls certificate: sha256:%s\n", certFingerprint(cert.Certificate[0]))
+		tconn = tls.Server(conn, &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			Certificates: []tls.Certificate{cert},
+		})
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := tconn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	// channel binding
+	state := tconn.ConnectionState()
+	ekm, err := state.ExportKeyingMaterial("EXPORTER-gole-binding", nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	bkey := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, sessKey, nil, []byte("gole-tls")), bkey); err != nil {
+		return nil, err
+	}
+	binding := func(role string) []byte {
+		mac := hmac.New(sha256.New, bkey)
+		mac.Write([]byte(role))
+		mac.Write(ekm)
+		return mac.Sum(nil)
+	}
+	ours, theirs := "client", "server"
+	if !client {
+		ours, theirs = theirs, ours
+	}
+	if _, err = tconn.Write(binding(ours)); err != nil {
+		return nil, err
+	}
+	peer := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(tconn, peer); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(peer, binding(theirs)) {
+		return nil, errTLSBinding
+	}
+
+	fmt.Printf("tls established: %s\n", tls.CipherSuiteName(state.CipherSuite))
+	return tconn, nil
+}
@@ -0,0 +1,223 @@
+package main
+//
+// -ttl=auto: traceroute towards the peer to find how far away the first
+// public router is
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+const (
+	ttlAuto = -1
+	ttlMaxHops = 16
+	ttlProbeWait = 800 * time.Millisecond
+	ttlProbeTries = 2
+	ttlMaxSilent = 3 // give up after this many hops in a row don't answer
+)
+
+var errNoRecvErr = errors.New("icmp errors not readable from udp socket")
+
+// Params:
+//   0|auto|1-255
+func parseTTL(s string) int {
+	if strings.ToLower(s) == "auto" {
+		return ttlAuto
+	}
+	ttl, err := strconv.Atoi(s)
+	if err != nil || ttl < 0 || ttl > 255 {
+		perror("Invalid ttl.", errors.New(s))
+		os.Exit(1)
+	}
+	return ttl
+}
+
+// An ICMP time exceeded or unreachable for one of our probes.
+type hopReply struct {
+	ip net.IP
+	unreach bool
+}
+
+// Where ICMP errors for probes sent on a udp socket come from.
+type hopReader interface {
+	read(timeout time.Duration) (*hopReply, error)
+	Close() error
+}
+
+type recvErrReader struct {
+	conn *net.UDPConn
+}
+func (r *recvErrReader) read(timeout time.Duration) (*hopReply, error) {
+	_, ip, unreach, err := readRecvErr(r.conn, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &hopReply{ip, unreach}, nil
+}
+func (r *recvErrReader) Close() error { return nil }
+
+// Raw ICMP socket, needs root, matches replies by the quoted source port.
+type rawICMPReader struct {
+	pc *icmp.PacketConn
+	proto int
+	port int
+}
+func newRawICMPReader(laddr *net.UDPAddr, v6 bool) (*rawICMPReader, error) {
+	network, addr, proto := "ip4:icmp", "0.0.0.0", 1
+	if v6 {
+		network, addr, proto = "ip6:ipv6-icmp", "::", 58
+	}
+	pc, err := icmp.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &rawICMPReader{pc, proto, laddr.Port}, nil
+}
+func (r *rawICMPReader) read(timeout time.Duration) (*hopReply, error) {
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(timeout)
+	r.pc.SetReadDeadline(deadline)
+	for {
+		n, from, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		m, err := icmp.ParseMessage(r.proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		var data []byte
+		unreach := false
+		switch b := m.Body.(type) {
+		case *icmp.TimeExceeded:
+			data = b.Data
+		case *icmp.DstUnreach:
+			data, unreach = b.Data, true
+		default:
+			continue
+		}
+
+		// quoted ip header, then our udp header
+		off := 40
+		if r.proto == 1 {
+			if len(data) < 1 {
+				continue
+			}
+			off = int(data[0]&0x0f) * 4
+		}
+		if len(data) < off+2 || int(data[off])<<8|int(data[off+1]) != r.port {
+			continue
+		}
+		return &hopReply{from.(*net.IPAddr).IP, unreach}, nil
+	}
+}
+func (r *rawICMPReader) Close() error { return r.pc.Close() }
+
+// 100.64.0.0/10, shared address space behind carrier-grade NATs
+func isCGNAT(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64
+}
+
+// Send probes towards @raddr with increasing ttl until a public router or
+// @raddr itself answers. Returns the hop of the first public router (0 if
+// none answered before @raddr) and the hop of @raddr (0 if not reached).
+func traceHops(raddr *net.UDPAddr) (int, int, error) {
+	v6 := isIPv6(raddr)
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	var hr hopReader
+	if err := enableRecvErr(conn, v6); err == nil {
+		hr = &recvErrReader{conn}
+	} else {
+		r, err := newRawICMPReader(conn.LocalAddr().(*net.UDPAddr), v6)
+		if err != nil {
+			return 0, 0, err
+		}
+		hr = r
+	}
+	defer hr.Close()
+
+	answered, silent := false, 0
+	for hop:=1; hop<=ttlMaxHops && silent<ttlMaxSilent; hop++ {
+		if err := setTTL(conn, v6, hop); err != nil {
+			return 0, 0, err
+		}
+		silent++
+		for try:=0; try<ttlProbeTries; try++ {
+			// drop late replies to earlier probes
+			for {
+				if _, err := hr.read(time.Millisecond); err != nil {
+					break
+				}
+			}
+			if _, err := conn.WriteToUDP([]byte("gole-ttl"), raddr); err != nil {
+				return 0, 0, err
+			}
+			r, err := hr.read(ttlProbeWait)
+			if err != nil {
+				continue
+			}
+			answered, silent = true, 0
+			PrintDbgf("ttl: hop %d %s\n", hop, r.ip)
+			if r.ip.Equal(raddr.IP) {
+				return 0, hop, nil
+			}
+			if !isPrivateIP(r.ip) && !isCGNAT(r.ip) {
+				return hop, 0, nil
+			}
+			if r.unreach {
+				return 0, 0, fmt.Errorf("%s unreachable at hop %d", raddr.IP, hop)
+			}
+			break
+		}
+	}
+	if !answered {
+		return 0, 0, errors.New("no icmp replies")
+	}
+	return 0, 0, errors.New("no public router answered")
+}
+
+// A ttl that takes our HELOs through our own NAT(s), opening the mapping,
+// but lets them die before they get near the peer's NAT. Returns the ttl
+// and the hop of the first public router, ttl is 0 if none is needed.
+func discoverTTL(raddr *net.UDPAddr) (int, int, error) {
+	pub, dest, err := traceHops(raddr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pub > 0 {
+		return pub, pub, nil
+	}
+	return dest - 1, 0, nil // peer is a hop or so away, on the same network
+}
+
+// discoverTTL() for -ttl=auto, returns the ttl to use or 0 to not set any
+func autoTTL(raddr *net.UDPAddr) int {
+	ttl, hop, err := discoverTTL(raddr)
+	if err != nil {
+		perror("ttl discovery failed, not setting ttl.", err)
+		return 0
+	} else if ttl < 1 {
+		fmt.Printf("ttl: auto, peer is on our network, not setting ttl\n")
+		return 0
+	}
+	fmt.Printf("ttl: auto picked %d (first public hop at %d)\n", ttl, hop)
+	return ttl
+}
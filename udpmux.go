@@ -0,0 +1,327 @@
+package main
+//
+// UDP muxing for 'udp' tunnels, each datagram carries the id of the flow
+// it belongs to, one flow per source address on the client's forward side.
+// Over 'kcp' each flow is an smux stream of length-prefixed datagrams.
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	udpFlowHeader = 4 // flow id, big endian
+	udpDatagramHeader = 2 // datagram length in a stream, big endian
+	udpMaxDatagram = 65535
+	udpFlowQueue = 64 // datagrams held for a stream being opened
+)
+
+type udpFlow struct {
+	id uint32
+	addr *net.UDPAddr // client: where the local app sends from
+	conn *net.UDPConn // server: socket dialed to the forward address
+	stream *smux.Stream // 'kcp' only
+	queue chan []byte // 'kcp' client: datagrams on their way to the stream
+	done chan struct{} // closed with the flow, client only
+	mu sync.Mutex
+	last time.Time
+	closed bool
+}
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	f.last = time.Now()
+	f.mu.Unlock()
+}
+func (f *udpFlow) idle() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.last)
+}
+func (f *udpFlow) close() {
+	f.mu.Lock()
+	if !f.closed && f.done != nil {
+		close(f.done)
+	}
+	f.closed = true
+	stream := f.stream
+	f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	if stream != nil {
+		stream.Close()
+	}
+}
+// give @f its stream, false if the flow was closed in the meantime
+func (f *udpFlow) attach(stream *smux.Stream) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.stream = stream
+	return true
+}
+
+type udpFlows struct {
+	mu sync.Mutex
+	byID map[uint32]*udpFlow
+	byAddr map[string]*udpFlow
+	next uint32
+	done chan struct{}
+}
+
+func newUDPFlows() *udpFlows {
+	return &udpFlows{
+		byID: make(map[uint32]*udpFlow),
+		byAddr: make(map[string]*udpFlow),
+		done: make(chan struct{}),
+	}
+}
+
+func (fs *udpFlows) get(id uint32) *udpFlow {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.byID[id]
+}
+
+// flow of a local source address, a new one is made if there is none
+func (fs *udpFlows) lookup(addr *net.UDPAddr) (*udpFlow, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f, ok := fs.byAddr[addr.String()]; ok {
+		return f, false
+	}
+	fs.next++
+	f := &udpFlow{id: fs.next, addr: addr, done: make(chan struct{}), last: time.Now()}
+	fs.byID[f.id] = f
+	fs.byAddr[addr.String()] = f
+	return f, true
+}
+
+func (fs *udpFlows) add(f *udpFlow) {
+	fs.mu.Lock()
+	f.last = time.Now()
+	fs.byID[f.id] = f
+	fs.mu.Unlock()
+}
+
+// the id may have been taken by a new flow once @f expired
+func (fs *udpFlows) remove(f *udpFlow) {
+	fs.mu.Lock()
+	if fs.byID[f.id] == f {
+		delete(fs.byID, f.id)
+	}
+	if f.addr != nil && fs.byAddr[f.addr.String()] == f {
+		delete(fs.byAddr, f.addr.String())
+	}
+	fs.mu.Unlock()
+	f.close()
+}
+
+// drop flows idle for longer than @timeout, until close()
+func (fs *udpFlows) expire(timeout time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fs.done:
+			return
+		}
+		var idle []*udpFlow
+		fs.mu.Lock()
+		for _, f := range fs.byID {
+			if f.idle() > timeout {
+				idle = append(idle, f)
+			}
+		}
+		fs.mu.Unlock()
+		for _, f := range idle {
+			PrintDbgf("flow expired(%d)\n", f.id)
+			fs.remove(f)
+		}
+	}
+}
+
+func (fs *udpFlows) close() {
+	fs.mu.Lock()
+	flows := fs.byID
+	fs.byID = make(map[uint32]*udpFlow)
+	fs.byAddr = make(map[string]*udpFlow)
+	fs.mu.Unlock()
+	close(fs.done)
+	for _, f := range flows {
+		f.close()
+	}
+}
+
+func putFlowID(b []byte, id uint32) {
+	binary.BigEndian.PutUint32(b, id)
+}
+func getFlowID(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
+
+// @b holds the datagram after udpDatagramHeader bytes of room
+func writeDatagram(w io.Writer, b []byte) error {
+	binary.BigEndian.PutUint16(b, uint16(len(b)-udpDatagramHeader))
+	_, err := w.Write(b)
+	return err
+}
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	if _, err := io.ReadFull(r, buf[:udpDatagramHeader]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Client side of udp forwarding over smux, a stream for each source
+// address sending to @addr, tagged with forward @id.
+func udp2streams(t *tunnel, addr *net.UDPAddr, id uint16) {
+	fwd_conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		perror("net.ListenUDP() failed.", err)
+		exit(1)
+	}
+	defer fwd_conn.Close()
+	fmt.Printf("Waiting for new datagrams from %s ...\n", addr)
+
+	flows := newUDPFlows()
+	go flows.expire(time.Duration(g_timeout) * time.Second)
+	defer flows.close()
+
+	// periodic check if smux session is still alive
+	go func() {
+		for {
+			time.Sleep(2*time.Second)
+			if t.done() {
+				fwd_conn.Close()
+				fmt.Printf("tunnel is closed\n")
+				break
+			}
+		}
+	}()
+
+	// stream --> fwd_conn
+	pump := func(f *udpFlow) {
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			n, err := readDatagram(f.stream, buf)
+			if err != nil {
+				break
+			}
+			f.touch()
+			if _, err := fwd_conn.WriteToUDP(buf[:n], f.addr); err != nil {
+				break
+			}
+		}
+		PrintDbgf("stream close(%d)\n", f.stream.ID())
+		flows.remove(f)
+	}
+
+	// queue --> stream, opening it may wait for a re-punch with -persist
+	send := func(f *udpFlow) {
+		stream, err := t.open(id)
+		if err != nil {
+			perror("sess.OpenStream() failed.", err)
+			flows.remove(f)
+			return
+		}
+		if !f.attach(stream) {
+			stream.Close()
+			return
+		}
+		PrintDbgf("stream open(%d): %v --> tunnel\n", stream.ID(), f.addr)
+		go pump(f)
+		for {
+			select {
+			case b := <-f.queue:
+				if err := writeDatagram(stream, b); err != nil {
+					flows.remove(f)
+					return
+				}
+			case <-f.done:
+				return
+			}
+		}
+	}
+
+	// fwd_conn --> queue
+	buf := make([]byte, udpDatagramHeader+udpMaxDatagram)
+	for {
+		n, c_addr, err := fwd_conn.ReadFromUDP(buf[udpDatagramHeader:])
+		if err != nil {
+			perror("fwd_conn.ReadFromUDP() failed.", err)
+			break
+		}
+
+		f, isNew := flows.lookup(c_addr)
+		if isNew {
+			f.queue = make(chan []byte, udpFlowQueue)
+			go send(f)
+		}
+		f.touch()
+		select {
+		case f.queue <- append([]byte(nil), buf[:udpDatagramHeader+n]...):
+		default:
+			// the flow's stream is slow or not open yet, drop
+		}
+	}
+}
+
+// Server side of udp forwarding over smux, datagrams from @stream go to
+// @addr from a socket of their own.
+func stream2udp(stream *smux.Stream, addr *net.UDPAddr, flows *udpFlows) {
+	fwd_conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		perror("net.DialUDP() failed.", err)
+		stream.Close()
+		return
+	}
+	f := &udpFlow{id: stream.ID(), conn: fwd_conn, stream: stream}
+	flows.add(f)
+	PrintDbgf("stream open(%d): tunnel --> %v\n", stream.ID(), fwd_conn.RemoteAddr())
+
+	// fwd_conn --> stream
+	go func() {
+		buf := make([]byte, udpDatagramHeader+udpMaxDatagram)
+		for {
+			n, err := fwd_conn.Read(buf[udpDatagramHeader:])
+			if err != nil {
+				break
+			}
+			f.touch()
+			if err := writeDatagram(stream, buf[:udpDatagramHeader+n]); err != nil {
+				break
+			}
+		}
+		flows.remove(f)
+	}()
+
+	// stream --> fwd_conn
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, err := readDatagram(stream, buf)
+		if err != nil {
+			break
+		}
+		f.touch()
+		if _, err := fwd_conn.Write(buf[:n]); err != nil {
+			PrintDbgf("fwd_conn.Write() failed. %v\n", err)
+		}
+	}
+	PrintDbgf("stream close(%d)\n", stream.ID())
+	flows.remove(f)
+}